@@ -1,18 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/pelletier/go-toml"
+	"github.com/voc/rtmp-auth/control"
 	"github.com/voc/rtmp-auth/http"
 	"github.com/voc/rtmp-auth/store"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func waitForSignal() {
@@ -39,11 +45,55 @@ func waitForSignal() {
 	<-done
 }
 
+// printPasswordHash reads a password from stdin and prints its bcrypt hash
+func printPasswordHash() {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal("read password", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if len(password) == 0 {
+		log.Fatal("password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatal("hash password", err)
+	}
+	fmt.Println(string(hash))
+}
+
+// printToken prints a signed token for an app/name pair
+func printToken(config store.StoreConfig, scope string, stream string, validity time.Duration) {
+	if scope != store.ScopePublish && scope != store.ScopePlay {
+		log.Fatal("invalid token scope ", scope)
+	}
+
+	parts := strings.SplitN(stream, "/", 2)
+	if len(parts) != 2 {
+		log.Fatal("token stream must be in the form app/name")
+	}
+
+	expiry := int64(-1)
+	if validity > 0 {
+		expiry = time.Now().Add(validity).Unix()
+	}
+
+	// the state is only read, the store may be in use by a running instance
+	key, err := store.ReadTokenKey(config)
+	if err != nil {
+		log.Fatal("Failed to read token key: ", err)
+	}
+	fmt.Println(store.SignToken(key, scope, parts[0], parts[1], expiry))
+}
+
 type Config struct {
 	APIAddress      string            `toml:"api-address"`
 	FrontendAddress string            `toml:"frontend-address"`
+	ExpireInterval  string            `toml:"expire-interval"`
 	Store           store.StoreConfig `toml:"store"`
 	HTTP            http.ServerConfig `toml:"http"`
+	// Ingest server control interfaces by application
+	Control map[string]control.Config `toml:"control"`
 }
 
 func main() {
@@ -51,11 +101,18 @@ func main() {
 	config := Config{
 		APIAddress:      "localhost:8080",
 		FrontendAddress: "localhost:8082",
+		ExpireInterval:  "5m",
 		Store: store.StoreConfig{
 			Backend: "file",
 			File: store.FileBackendConfig{
 				Path: "store.db",
 			},
+			Consul: store.ConsulBackendConfig{
+				Key: "stream_auth",
+			},
+			Bolt: store.BoltBackendConfig{
+				Path: "store.bolt",
+			},
 		},
 	}
 	var configPath = flag.String("config", "config.toml", "Config toml")
@@ -63,8 +120,17 @@ func main() {
 	var frontendAddr = flag.String("frontendAddr", "", "Frontend bind address")
 	var insecure = flag.Bool("insecure", false, "Set to allow non-secure CSRF cookie")
 	var prefix = flag.String("subpath", "", "Set to allow running behind reverse-proxy at that subpath")
+	var signToken = flag.String("sign-token", "", "Print a signed token for app/name and exit")
+	var tokenExpire = flag.Duration("token-expire", 0, "Validity of the signed token, 0 for never")
+	var tokenScope = flag.String("token-scope", store.ScopePublish, "Scope of the signed token (publish|play)")
+	var hashPassword = flag.Bool("hash-password", false, "Read a password from stdin, print its hash for the users config and exit")
 	flag.Parse()
 
+	if *hashPassword {
+		printPasswordHash()
+		return
+	}
+
 	if *apiAddr != "" {
 		config.APIAddress = *apiAddr
 	}
@@ -87,20 +153,36 @@ func main() {
 		log.Fatal("parse config", err)
 	}
 
+	if *signToken != "" {
+		printToken(config.Store, *tokenScope, *signToken, *tokenExpire)
+		return
+	}
+
 	out, _ := json.Marshal(&config)
 	log.Println("using config", string(out))
 
+	expireInterval, err := time.ParseDuration(config.ExpireInterval)
+	if err != nil || expireInterval <= 0 {
+		log.Fatal("invalid expire-interval ", config.ExpireInterval)
+	}
+
 	store, err := store.NewStore(config.Store)
 	if err != nil {
 		log.Fatal("Failed to create store", err)
 	}
 
+	controller, err := control.New(config.Control)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store.SetDropper(controller)
+
 	// Set up servers
 	api := http.NewAPI(config.APIAddress, config.HTTP, store)
 	frontend := http.NewFrontend(config.FrontendAddress, config.HTTP, store)
 
 	// Periodically expire old streams
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(expireInterval)
 	stopPolling := make(chan struct{})
 	go func() {
 		for {
@@ -109,6 +191,7 @@ func main() {
 				return
 			case <-ticker.C:
 				store.Expire()
+				store.ExpireLeases()
 			}
 		}
 	}()
@@ -0,0 +1,57 @@
+package control
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Config configures the control interface of the ingest server for an application
+type Config struct {
+	// Type of ingest server (nginx|srs)
+	Type string `toml:"type"`
+	// Base URL of the control interface,
+	// e.g. http://localhost:8080/control for the nginx-rtmp control module
+	// or http://localhost:1985 for the SRS HTTP API
+	URL string `toml:"url"`
+}
+
+// Dropper disconnects the publisher of a stream, an empty vhost is the default vhost
+type Dropper interface {
+	Drop(vhost string, app string, name string) error
+}
+
+// Controller drops publishers through the ingest server configured for their application
+type Controller struct {
+	droppers map[string]Dropper
+}
+
+func New(configs map[string]Config) (*Controller, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	droppers := make(map[string]Dropper)
+	for app, config := range configs {
+		base := strings.TrimRight(config.URL, "/")
+		switch config.Type {
+		case "nginx":
+			droppers[app] = &NginxDropper{url: base, client: client}
+		case "srs":
+			droppers[app] = &SRSDropper{url: base, client: client}
+		default:
+			return nil, fmt.Errorf("control: unknown type '%v' for application %v", config.Type, app)
+		}
+		log.Printf("control: dropping publishers of %v through %v at %v\n", app, config.Type, config.URL)
+	}
+	return &Controller{droppers: droppers}, nil
+}
+
+// Drop disconnects the publisher of app/name on vhost, returns false for applications
+// without a configured control interface
+func (c *Controller) Drop(vhost string, app string, name string) (bool, error) {
+	dropper, ok := c.droppers[app]
+	if !ok {
+		return false, nil
+	}
+	return true, dropper.Drop(vhost, app, name)
+}
@@ -0,0 +1,47 @@
+package control
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControllerDrop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "1")
+	}))
+	defer server.Close()
+
+	controller, err := New(map[string]Config{
+		"stream": {Type: "nginx", URL: server.URL + "/control/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		app     string
+		dropped bool
+	}{
+		{"stream", true},
+		{"other", false},
+	}
+	for _, test := range tests {
+		t.Run(test.app, func(t *testing.T) {
+			dropped, err := controller.Drop("", test.app, "foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dropped != test.dropped {
+				t.Errorf("dropped = %v, want %v", dropped, test.dropped)
+			}
+		})
+	}
+}
+
+func TestNewUnknownType(t *testing.T) {
+	if _, err := New(map[string]Config{"stream": {Type: "wowza"}}); err == nil {
+		t.Error("expected error for unknown type")
+	}
+}
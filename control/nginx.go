@@ -0,0 +1,37 @@
+package control
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// NginxDropper uses the nginx-rtmp control module
+type NginxDropper struct {
+	url    string
+	client *http.Client
+}
+
+// Drop ignores the vhost, nginx-rtmp has no virtual hosts
+func (d *NginxDropper) Drop(vhost string, app string, name string) error {
+	query := url.Values{}
+	query.Set("app", app)
+	query.Set("name", name)
+	resp, err := d.client.Get(d.url + "/drop/publisher?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("nginx drop: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("nginx drop: unexpected status %v", resp.Status)
+	}
+	// the control module responds with the number of dropped clients
+	if strings.TrimSpace(string(body)) == "0" {
+		return fmt.Errorf("nginx drop: no publisher on %v/%v", app, name)
+	}
+	return nil
+}
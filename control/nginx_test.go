@@ -0,0 +1,50 @@
+package control
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNginxDrop(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		fail   bool
+	}{
+		{name: "dropped", status: http.StatusOK, body: "1"},
+		{name: "dropped with newline", status: http.StatusOK, body: "2\n"},
+		{name: "no publisher", status: http.StatusOK, body: "0", fail: true},
+		{name: "no publisher with newline", status: http.StatusOK, body: "0\n", fail: true},
+		{name: "error", status: http.StatusNotFound, body: "", fail: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var query string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/control/drop/publisher" {
+					http.NotFound(w, r)
+					return
+				}
+				query = r.URL.RawQuery
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer server.Close()
+
+			dropper := &NginxDropper{url: server.URL + "/control", client: server.Client()}
+			err := dropper.Drop("", "stream", "foo bar")
+			if test.fail && err == nil {
+				t.Error("expected error")
+			}
+			if !test.fail && err != nil {
+				t.Error(err)
+			}
+			if want := "app=stream&name=foo+bar"; query != want {
+				t.Errorf("query = %q, want %q", query, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// SRSDropper kicks clients through the SRS HTTP API
+type SRSDropper struct {
+	url    string
+	client *http.Client
+}
+
+type srsStreams struct {
+	Code    int `json:"code"`
+	Streams []struct {
+		// Vhost is the id of the vhost
+		Vhost   string `json:"vhost"`
+		App     string `json:"app"`
+		Name    string `json:"name"`
+		Publish struct {
+			Active bool   `json:"active"`
+			Cid    string `json:"cid"`
+		} `json:"publish"`
+	} `json:"streams"`
+}
+
+type srsVhosts struct {
+	Code   int `json:"code"`
+	Vhosts []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"vhosts"`
+}
+
+type srsResponse struct {
+	Code int `json:"code"`
+}
+
+// srsDefaultVhost is the name SRS uses for the default vhost
+const srsDefaultVhost = "__defaultVhost__"
+
+// get decodes a response of the SRS HTTP API into v
+func (d *SRSDropper) get(path string, v interface{}) error {
+	resp, err := d.client.Get(d.url + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// vhostNames maps the vhost ids to their names, the default vhost is named empty
+func (d *SRSDropper) vhostNames() (map[string]string, error) {
+	var vhosts srsVhosts
+	if err := d.get("/api/v1/vhosts/", &vhosts); err != nil {
+		return nil, err
+	}
+	if vhosts.Code != 0 {
+		return nil, fmt.Errorf("error code %v", vhosts.Code)
+	}
+	names := make(map[string]string, len(vhosts.Vhosts))
+	for _, vhost := range vhosts.Vhosts {
+		if vhost.Name == srsDefaultVhost {
+			vhost.Name = ""
+		}
+		names[vhost.Id] = vhost.Name
+	}
+	return names, nil
+}
+
+// publisher looks up the client id publishing app/name on vhost
+func (d *SRSDropper) publisher(vhost string, app string, name string) (string, error) {
+	names, err := d.vhostNames()
+	if err != nil {
+		return "", err
+	}
+	var streams srsStreams
+	if err := d.get("/api/v1/streams/?count=10000", &streams); err != nil {
+		return "", err
+	}
+	if streams.Code != 0 {
+		return "", fmt.Errorf("error code %v", streams.Code)
+	}
+	for _, stream := range streams.Streams {
+		if stream.App == app && stream.Name == name && names[stream.Vhost] == vhost && stream.Publish.Active {
+			return stream.Publish.Cid, nil
+		}
+	}
+	if vhost != "" {
+		return "", fmt.Errorf("no publisher on %v/%v/%v", vhost, app, name)
+	}
+	return "", fmt.Errorf("no publisher on %v/%v", app, name)
+}
+
+func (d *SRSDropper) Drop(vhost string, app string, name string) error {
+	cid, err := d.publisher(vhost, app, name)
+	if err != nil {
+		return fmt.Errorf("srs drop: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, d.url+"/api/v1/clients/"+cid, nil)
+	if err != nil {
+		return fmt.Errorf("srs drop: %w", err)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("srs drop: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var res srsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("srs drop: %w", err)
+	}
+	if res.Code != 0 {
+		return fmt.Errorf("srs drop: error code %v", res.Code)
+	}
+	return nil
+}
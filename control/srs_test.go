@@ -0,0 +1,72 @@
+package control
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// srsAPI fakes the SRS HTTP API with a publisher of stream/foo on the default vhost and on a.example
+func srsAPI(t *testing.T, deleted *[]string, deleteCode int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/vhosts/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"code":0,"vhosts":[{"id":"vid-default","name":"__defaultVhost__"},{"id":"vid-a","name":"a.example"}]}`)
+	})
+	mux.HandleFunc("/api/v1/streams/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"code":0,"streams":[`+
+			`{"vhost":"vid-default","app":"stream","name":"foo","publish":{"active":true,"cid":"client-default"}},`+
+			`{"vhost":"vid-a","app":"stream","name":"foo","publish":{"active":true,"cid":"client-a"}},`+
+			`{"vhost":"vid-default","app":"stream","name":"idle","publish":{"active":false,"cid":""}}]}`)
+	})
+	mux.HandleFunc("/api/v1/clients/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("method = %v, want DELETE", r.Method)
+		}
+		*deleted = append(*deleted, r.URL.Path)
+		fmt.Fprintf(w, `{"code":%d}`, deleteCode)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestSRSDrop(t *testing.T) {
+	tests := []struct {
+		name       string
+		vhost      string
+		stream     string
+		deleteCode int
+		deleted    string
+		fail       bool
+	}{
+		{name: "default vhost", stream: "foo", deleted: "/api/v1/clients/client-default"},
+		{name: "vhost", vhost: "a.example", stream: "foo", deleted: "/api/v1/clients/client-a"},
+		{name: "other vhost", vhost: "b.example", stream: "foo", fail: true},
+		{name: "inactive", stream: "idle", fail: true},
+		{name: "unknown", stream: "bar", fail: true},
+		{name: "delete failed", stream: "foo", deleteCode: 2049, deleted: "/api/v1/clients/client-default", fail: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var deleted []string
+			server := srsAPI(t, &deleted, test.deleteCode)
+			defer server.Close()
+
+			dropper := &SRSDropper{url: server.URL, client: server.Client()}
+			err := dropper.Drop(test.vhost, "stream", test.stream)
+			if test.fail && err == nil {
+				t.Error("expected error")
+			}
+			if !test.fail && err != nil {
+				t.Error(err)
+			}
+
+			var want []string
+			if test.deleted != "" {
+				want = []string{test.deleted}
+			}
+			if fmt.Sprint(deleted) != fmt.Sprint(want) {
+				t.Errorf("deleted %v, want %v", deleted, want)
+			}
+		})
+	}
+}
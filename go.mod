@@ -8,19 +8,22 @@ replace google.golang.org/grpc => google.golang.org/grpc v1.26.0
 
 require (
 	github.com/armon/go-metrics v0.4.1 // indirect
+	github.com/coreos/go-oidc/v3 v3.5.0
 	github.com/fatih/color v1.15.0 // indirect
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/csrf v1.7.1
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/securecookie v1.1.1
 	github.com/hashicorp/consul/api v1.20.0
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
 	github.com/hashicorp/go-hclog v1.5.0 // indirect
 	github.com/hashicorp/go-immutable-radix v1.3.1 // indirect
 	github.com/mattn/go-isatty v0.0.18 // indirect
-	github.com/mitchellh/go-testing-interface v1.0.0 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/pelletier/go-toml v1.9.5
 	github.com/rakyll/statik v0.1.7
-	golang.org/x/sys v0.7.0 // indirect
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.8.0
+	golang.org/x/oauth2 v0.7.0
 	google.golang.org/protobuf v1.30.0
 )
@@ -0,0 +1,287 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserConfig defines a local frontend user
+type UserConfig struct {
+	Name string `toml:"name"`
+	// bcrypt hash as printed by rtmp-auth -hash-password
+	PasswordHash string `toml:"password-hash" json:"-"`
+}
+
+// APITokenConfig allows access to the JSON API with a bearer token
+type APITokenConfig struct {
+	// Name identifies the token in grants as user "token:<name>"
+	Name  string `toml:"name"`
+	Token string `toml:"token" json:"-"`
+}
+
+const (
+	sessionCookie   = "rtmp-auth-session"
+	sessionLifetime = 12 * time.Hour
+)
+
+var (
+	errInvalidLogin = errors.New("invalid user name or password")
+	errInvalidToken = errors.New("invalid API token")
+	errLoginNeeded  = errors.New("login or API token required")
+)
+
+// dummyHash is compared against for unknown users to not leak valid user names through timing
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("rtmp-auth"), bcrypt.DefaultCost)
+
+// Session is stored in a signed cookie for logged in users
+type Session struct {
+	User    string
+	Groups  []string
+	Expires int64
+}
+
+type sessionKey struct{}
+
+// getSession returns the session of an authenticated request or nil
+func getSession(r *http.Request) *Session {
+	session, _ := r.Context().Value(sessionKey{}).(*Session)
+	return session
+}
+
+// Authenticator guards the frontend with a session login
+type Authenticator struct {
+	config ServerConfig
+	codec  *securecookie.SecureCookie
+	OIDC   *OIDCLogin
+}
+
+func NewAuthenticator(config ServerConfig, secret []byte) *Authenticator {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("rtmp-auth session"))
+	codec := securecookie.New(mac.Sum(nil), nil)
+	codec.MaxAge(int(sessionLifetime.Seconds()))
+	auth := &Authenticator{config: config, codec: codec}
+	auth.OIDC = NewOIDCLogin(config.OIDC, auth)
+	return auth
+}
+
+// Enabled returns whether any login method is configured
+func (auth *Authenticator) Enabled() bool {
+	return len(auth.config.Users) > 0 || auth.OIDC.Enabled()
+}
+
+func (auth *Authenticator) cookiePath() string {
+	if auth.config.Prefix == "" {
+		return "/"
+	}
+	return auth.config.Prefix
+}
+
+// login checks the credentials of a local user
+func (auth *Authenticator) login(name string, password string) bool {
+	for _, user := range auth.config.Users {
+		if user.Name == name {
+			err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+			return err == nil
+		}
+	}
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return false
+}
+
+// setSession issues a new session cookie
+func (auth *Authenticator) setSession(w http.ResponseWriter, session *Session) error {
+	session.Expires = time.Now().Add(sessionLifetime).Unix()
+	value, err := auth.codec.Encode(sessionCookie, session)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     auth.cookiePath(),
+		Expires:  time.Unix(session.Expires, 0),
+		Secure:   !auth.config.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (auth *Authenticator) clearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     auth.cookiePath(),
+		MaxAge:   -1,
+		Secure:   !auth.config.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readSession returns the valid session of a request or nil
+func (auth *Authenticator) readSession(r *http.Request) *Session {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var session Session
+	if err := auth.codec.Decode(sessionCookie, cookie.Value, &session); err != nil {
+		return nil
+	}
+	if session.Expires < time.Now().Unix() {
+		return nil
+	}
+	return &session
+}
+
+// isPublic returns whether a path is reachable without login
+func (auth *Authenticator) isPublic(path string) bool {
+	path = strings.TrimPrefix(path, auth.config.Prefix)
+	return path == "/login" || path == "/oidc/login" || path == "/oidc/callback" ||
+		strings.HasPrefix(path, "/public/")
+}
+
+// isAPI returns whether a path belongs to the JSON API
+func (auth *Authenticator) isAPI(path string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(path, auth.config.Prefix), "/v1/")
+}
+
+// tokenSession returns the session of a valid API bearer token or nil
+func (auth *Authenticator) tokenSession(r *http.Request) *Session {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	token := []byte(strings.TrimPrefix(header, "Bearer "))
+	for _, t := range auth.config.APITokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), token) == 1 {
+			return &Session{User: "token:" + t.Name}
+		}
+	}
+	return nil
+}
+
+// TokenMiddleware authenticates JSON API requests with a bearer token.
+// Token requests skip the CSRF check, as browsers never send the Authorization header on their own,
+// so it has to wrap the CSRF handler.
+func (auth *Authenticator) TokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.isAPI(r.URL.Path) || r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session := auth.tokenSession(r)
+		if session == nil {
+			writeError(w, http.StatusUnauthorized, errInvalidToken)
+			return
+		}
+		ctx := context.WithValue(r.Context(), sessionKey{}, session)
+		next.ServeHTTP(w, csrf.UnsafeSkipCheck(r.WithContext(ctx)))
+	})
+}
+
+// Middleware redirects requests without a valid session to the login page,
+// JSON API requests are rejected instead
+func (auth *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// authenticated by API token
+		if getSession(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		api := auth.isAPI(r.URL.Path)
+		required := auth.Enabled() || (api && len(auth.config.APITokens) > 0)
+		if !required || auth.isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session := auth.readSession(r)
+		if session == nil && api {
+			writeError(w, http.StatusUnauthorized, errLoginNeeded)
+			return
+		}
+		if session == nil {
+			http.Redirect(w, r, auth.config.Prefix+"/login", http.StatusSeeOther)
+			return
+		}
+		ctx := context.WithValue(r.Context(), sessionKey{}, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type LoginTemplateData struct {
+	Config       ServerConfig
+	CsrfTemplate template.HTML
+	Errors       []error
+	Local        bool
+	OIDC         bool
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, auth *Authenticator, errs []error) {
+	data := LoginTemplateData{
+		Config:       auth.config,
+		CsrfTemplate: csrf.TemplateField(r),
+		Errors:       errs,
+		Local:        len(auth.config.Users) > 0,
+		OIDC:         auth.OIDC.Enabled(),
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	err := templates.ExecuteTemplate(w, "login.html", data)
+	if err != nil {
+		log.Println("Template failed", err)
+	}
+}
+
+func LoginFormHandler(auth *Authenticator) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderLogin(w, r, auth, nil)
+	}
+}
+
+func LoginHandler(auth *Authenticator, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PostFormValue("user")
+		if !auth.login(name, r.PostFormValue("password")) {
+			log.Printf("login failed for user '%v'", name)
+			renderLogin(w, r, auth, []error{errInvalidLogin})
+			return
+		}
+
+		if err := auth.setSession(w, &Session{User: name}); err != nil {
+			log.Println("session", err)
+			renderLogin(w, r, auth, []error{err})
+			return
+		}
+		log.Printf("user '%v' logged in", name)
+		http.Redirect(w, r, config.Prefix+"/", http.StatusSeeOther)
+	}
+}
+
+func LogoutHandler(auth *Authenticator, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if session := getSession(r); session != nil {
+			log.Printf("user '%v' logged out", session.User)
+		}
+		auth.clearSession(w)
+		http.Redirect(w, r, config.Prefix+"/login", http.StatusSeeOther)
+	}
+}
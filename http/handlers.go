@@ -2,16 +2,18 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"github.com/voc/rtmp-auth/ingest"
 	"github.com/voc/rtmp-auth/storage"
 	"github.com/voc/rtmp-auth/store"
 )
@@ -64,139 +66,252 @@ func parseExpiry(str string) *int64 {
 	return &expiry
 }
 
-type SRSPublish struct {
-	Action string `json:"action"`
-	IP     string `json:"ip"`
-	VHost  string `json:"vhost"`
-	App    string `json:"app"`
-	Url    string `json:"tcUrl"`
-	Stream string `json:"stream"`
-	Param  string `json:"param"`
+// authStatus maps store auth errors to HTTP status codes
+func authStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrUnknownStream):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrWrongKey):
+		return http.StatusUnauthorized
+	case errors.Is(err, store.ErrBlocked):
+		return http.StatusForbidden
+	case errors.Is(err, store.ErrExpired):
+		return http.StatusGone
+	case errors.Is(err, store.ErrConflict):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// newSession describes the publish of an event
+func newSession(event *ingest.Event) *storage.Session {
+	return &storage.Session{
+		ClientIp:   event.ClientIP,
+		Started:    time.Now().Unix(),
+		Server:     event.Server,
+		ServerAddr: event.ServerAddr,
+		TcUrl:      event.TcURL,
+		Vhost:      event.VHost,
+	}
+}
+
+// denied returns the result of a rejected event
+func denied(err error) ingest.Result {
+	return ingest.Result{Err: err, Status: authStatus(err)}
 }
 
-func handleSRSPublish(r *http.Request) (app string, name string, auth string, action string, err error) {
-	defer r.Body.Close()
-	var publish SRSPublish
-	dec := json.NewDecoder(r.Body)
-	err = dec.Decode(&publish)
+func handlePublish(store *store.Store, event *ingest.Event) ingest.Result {
+	id, key, err := store.Auth(event.VHost, event.App, event.Name, event.Key)
 	if err != nil {
-		return
+		res := denied(err)
+		log.Printf("Publish %s %s/%s rejected (%d): %v\n", id, event.App, event.Name, res.Status, err)
+		return res
 	}
 
-	// skip question mark
-	if len(publish.Param) > 0 {
-		publish.Param = publish.Param[1:]
+	var res ingest.Result
+	if !event.NoUnpublish && id != "" {
+		if err := store.SetActive(id, newSession(event)); err != nil {
+			res := denied(err)
+			log.Printf("Publish %s %s/%s rejected (%d): %v\n", id, event.App, event.Name, res.Status, err)
+			return res
+		}
+	}
+	if stream, err := store.GetStream(id); err == nil && stream.AuthExpire != -1 {
+		res.Lifetime = time.Until(time.Unix(stream.AuthExpire, 0))
 	}
+	log.Printf("Publish %s %s/%s with key '%s' from %s via %s ok\n", id, event.App, event.Name, key, event.ClientIP, event.Server)
+	return res
+}
 
-	val, err := url.ParseQuery(publish.Param)
+func handleUnpublish(store *store.Store, event *ingest.Event) ingest.Result {
+	store.SetInactive(event.VHost, event.App, event.Name)
+	log.Printf("Unpublish %s/%s ok\n", event.App, event.Name)
+	return ingest.Result{}
+}
+
+// handleUpdate re-validates an active stream and refreshes its lease.
+// Rejecting makes nginx-rtmp drop the publisher,
+// i.e. if the stream was blocked, removed, has expired or its key was changed.
+func handleUpdate(store *store.Store, event *ingest.Event) ingest.Result {
+	id, _, err := store.Auth(event.VHost, event.App, event.Name, event.Key)
 	if err != nil {
-		return
+		res := denied(err)
+		log.Printf("Update %s %s/%s rejected (%d): %v\n", id, event.App, event.Name, res.Status, err)
+		return res
+	}
+
+	// reclaim streams whose lease ran out while still publishing
+	if !store.Refresh(event.VHost, event.App, event.Name) && id != "" {
+		if err := store.SetActive(id, newSession(event)); err != nil {
+			log.Printf("Update %s %s/%s failed to reclaim: %v\n", id, event.App, event.Name, err)
+		}
 	}
-	app = publish.App
-	name = publish.Stream
-	auth = val.Get("auth")
-	action = publish.Action
-	return
+	return ingest.Result{}
 }
 
-func handleNginxPublish(r *http.Request) (app string, name string, auth string, action string, err error) {
-	err = r.ParseForm()
+func handlePlay(store *store.Store, config ServerConfig, event *ingest.Event) ingest.Result {
+	if isPublicPlayback(config, event.App) {
+		return ingest.Result{}
+	}
+
+	id, err := store.AuthPlay(event.VHost, event.App, event.Name, event.Key)
 	if err != nil {
-		return
+		res := denied(err)
+		log.Printf("Play %s %s/%s by %s rejected (%d): %v\n", id, event.App, event.Name, event.ClientIP, res.Status, err)
+		return res
+	}
+	log.Printf("Play %s %s/%s by %s ok\n", id, event.App, event.Name, event.ClientIP)
+	return ingest.Result{}
+}
+
+// isKeyAsName returns whether publishers of an application use their key as stream name
+func isKeyAsName(config ServerConfig, app string) bool {
+	for _, keyApp := range config.KeyAsName {
+		if keyApp == app {
+			return true
+		}
 	}
+	return false
+}
 
-	app = r.PostForm.Get("app")
-	name = r.PostForm.Get("name")
-	auth = r.PostForm.Get("auth")
-	action = r.PostForm.Get("call")
-	return
+// resolveKeyName replaces a stream name which is an auth key by the public name of its stream.
+// nginx-rtmp keeps sending the original name in on_update and on_publish_done after a rename.
+func resolveKeyName(store *store.Store, event *ingest.Event) bool {
+	name, ok := store.KeyName(event.VHost, event.App, event.Name)
+	if !ok {
+		return false
+	}
+	event.Key = event.Name
+	event.Name = name
+	return true
 }
 
-func PublishHandler(store *store.Store) handleFunc {
+// IngestHandler handles the callbacks of ingest servers. The adapter is taken from the route,
+// the ingest config or detected from the request. The key is read from the key sources of the application.
+// Players are allowed without checks unless playAuth is set.
+func IngestHandler(store *store.Store, config ServerConfig, adapters *ingest.Registry, keySources map[string][]ingest.KeySource, playAuth bool) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		var app string
-		var name string
-		var auth string
-		var action string
-		var err error
-
-		if r.Header.Get("Content-Type") == "application/json" {
-			// SRS publish handler
-			app, name, auth, action, err = handleSRSPublish(r)
-			if action != "on_publish" {
-				err = fmt.Errorf("invalid action %s", action)
-			}
-		} else {
-			// Form DATA from nginx-rtmp/srtrelay
-			app, name, auth, action, err = handleNginxPublish(r)
-			log.Println("publish action", action)
-
-			// only apply auth for publish
-			if action != "publish" {
-				return
-			}
+		name := mux.Vars(r)["adapter"]
+		if name == "" {
+			name = config.Ingest
 		}
-		log.Println(app, name, auth, err)
-		if err != nil {
-			log.Println("Failed to parse publish data:", err)
-			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		if name == "" {
+			name = ingest.Detect(r)
+		}
+		adapter, ok := adapters.Get(name)
+		if !ok {
+			http.Error(w, "404 Not Found", http.StatusNotFound)
 			return
 		}
 
-		log.Printf("publish %s/%s auth: '%s'\n", app, name, auth)
-
-		success, id := store.Auth(app, name, auth)
-		if !success {
-			log.Printf("Publish %s %s/%s unauthorized\n", id, app, name)
+		event, err := adapter.Decode(r)
+		if errors.Is(err, ingest.ErrUnauthorized) {
+			log.Printf("Rejected %s callback: %v\n", name, err)
 			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
 			return
+		} else if err != nil {
+			log.Printf("Failed to parse %s callback: %v\n", name, err)
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
 		}
 
-		store.SetActive(id)
-		log.Printf("Publish %s %s/%s ok\n", id, app, name)
+		sources, ok := keySources[event.App]
+		if !ok {
+			sources, ok = keySources["*"]
+		}
+		if ok {
+			ingest.ExtractKey(event, sources)
+		}
 
-		// SRS needs zero response
-		w.Write([]byte("0"))
-	}
-}
+		renamed := false
+		if event.CanRename && event.Action != ingest.ActionPlay && isKeyAsName(config, event.App) {
+			renamed = resolveKeyName(store, event)
+		}
 
-func UnpublishHandler(store *store.Store) handleFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var app string
-		var name string
-		var action string
-		var err error
-
-		if r.Header.Get("Content-Type") == "application/json" {
-			// SRS publish handler
-			app, name, _, action, err = handleSRSPublish(r)
-			if action != "on_unpublish" {
-				err = fmt.Errorf("invalid action %s", action)
+		var res ingest.Result
+		switch event.Action {
+		case ingest.ActionPublish:
+			res = handlePublish(store, event)
+			if renamed {
+				res.Rename = event.Name
 			}
-		} else {
-			// Form DATA from nginx-rtmp/srtrelay
-			app, name, _, action, err = handleNginxPublish(r)
-			log.Println("unpublish action", action)
-			// ignore actions except unpublish
-			if action != "unpublish" {
-				return
+		case ingest.ActionUnpublish:
+			res = handleUnpublish(store, event)
+		case ingest.ActionUpdate:
+			res = handleUpdate(store, event)
+		case ingest.ActionPlay:
+			if playAuth {
+				res = handlePlay(store, config, event)
 			}
 		}
+		adapter.Encode(w, event, res)
+	}
+}
 
-		if err != nil {
-			log.Println("Failed to parse unpublish data:", err)
-			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+// SRSHeartbeat is sent periodically by SRS if heartbeats are enabled
+type SRSHeartbeat struct {
+	DeviceId string `json:"device_id"`
+	IP       string `json:"ip"`
+}
+
+// HeartbeatHandler refreshes the leases of all streams on the SRS server sending the heartbeat
+func HeartbeatHandler(store *store.Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var heartbeat SRSHeartbeat
+		if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil {
+			log.Println("Failed to parse heartbeat:", err)
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
 			return
 		}
-		store.SetInactive(app, name)
-		log.Printf("Unpublish %s/%s ok\n", app, name)
+		store.RefreshServer(ingest.RemoteHost(r), heartbeat.DeviceId)
 
 		// SRS needs zero response
 		w.Write([]byte("0"))
 	}
 }
 
+// isPublicPlayback returns whether anyone may play streams of an application
+func isPublicPlayback(config ServerConfig, app string) bool {
+	for _, public := range config.PublicPlayback {
+		if public == app {
+			return true
+		}
+	}
+	return false
+}
+
+func newTemplateData(r *http.Request, store *store.Store, config ServerConfig, state *storage.State, errs []error) TemplateData {
+	var user string
+	if session := getSession(r); session != nil {
+		user = session.User
+	}
+
+	// Only show streams the user may see
+	perms := getPermissions(r, config)
+	if state != nil {
+		var visible []*storage.Stream
+		for _, stream := range state.Streams {
+			if perms.CanView(stream.Application) {
+				visible = append(visible, stream)
+			}
+		}
+		state.Streams = visible
+	}
+
+	return TemplateData{
+		User:         user,
+		Perms:        perms,
+		State:        state,
+		Config:       config,
+		CsrfTemplate: csrf.TemplateField(r),
+		Errors:       errs,
+		Tokens:       store.TokensEnabled(),
+	}
+}
+
 func FormHandler(store *store.Store, config ServerConfig) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errs []error
@@ -209,12 +324,7 @@ func FormHandler(store *store.Store, config ServerConfig) handleFunc {
 			return state.Streams[i].Name < state.Streams[j].Name
 		})
 
-		data := TemplateData{
-			State:        state,
-			Config:       config,
-			CsrfTemplate: csrf.TemplateField(r),
-			Errors:       errs,
-		}
+		data := newTemplateData(r, store, config, state, errs)
 		err = templates.ExecuteTemplate(w, "form.html", data)
 		if err != nil {
 			log.Println("Template failed", err)
@@ -236,12 +346,24 @@ func AddHandler(store *store.Store, config ServerConfig) handleFunc {
 			errs = append(errs, fmt.Errorf("stream name must be set"))
 		}
 
+		app := r.PostFormValue("application")
+		if !getPermissions(r, config).CanEdit(app) {
+			errs = append(errs, errForbidden("add", app))
+		}
+
+		vhost := r.PostFormValue("vhost")
+		if err := validateVhost(vhost, config); err != nil {
+			errs = append(errs, err)
+		}
+
 		// TODO: more validation
 		if len(errs) == 0 {
 			stream := &storage.Stream{
 				Name:        name,
-				Application: r.PostFormValue("application"),
+				Application: app,
+				Vhost:       vhost,
 				AuthKey:     r.PostFormValue("auth_key"),
+				PlayKey:     r.PostFormValue("play_key"),
 				AuthExpire:  *expiry,
 				Notes:       r.PostFormValue("notes"),
 			}
@@ -258,12 +380,119 @@ func AddHandler(store *store.Store, config ServerConfig) handleFunc {
 		if err != nil {
 			errs = append(errs, err)
 		}
-		data := TemplateData{
-			State:        state,
-			Config:       config,
-			CsrfTemplate: csrf.TemplateField(r),
-			Errors:       errs,
+		data := newTemplateData(r, store, config, state, errs)
+		err = templates.ExecuteTemplate(w, "form.html", data)
+		if err != nil {
+			log.Println("Template failed", err)
 		}
+	}
+}
+
+func EditHandler(store *store.Store, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errs []error
+		id := r.PostFormValue("id")
+
+		expiry := parseExpiry(r.PostFormValue("auth_expire"))
+		if expiry == nil {
+			errs = append(errs, fmt.Errorf("invalid auth expiry: '%v'", r.PostFormValue("auth_expire")))
+		}
+
+		name := r.PostFormValue("name")
+		if len(name) == 0 {
+			errs = append(errs, fmt.Errorf("stream name must be set"))
+		}
+
+		// Editing requires admin on the previous and the new application
+		app := r.PostFormValue("application")
+		perms := getPermissions(r, config)
+		if !perms.CanEdit(app) {
+			errs = append(errs, errForbidden("edit", app))
+		}
+
+		vhost := r.PostFormValue("vhost")
+		if err := validateVhost(vhost, config); err != nil {
+			errs = append(errs, err)
+		}
+
+		if len(errs) == 0 {
+			_, err := store.UpdateStream(id, func(stream *storage.Stream) error {
+				if !perms.CanEdit(stream.Application) {
+					return errForbidden("edit", stream.Application)
+				}
+				stream.Name = name
+				stream.Application = app
+				stream.Vhost = vhost
+				stream.AuthKey = r.PostFormValue("auth_key")
+				stream.PlayKey = r.PostFormValue("play_key")
+				stream.AuthExpire = *expiry
+				stream.Notes = r.PostFormValue("notes")
+				return nil
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to edit stream: %w", err))
+			} else {
+				log.Printf("edited Stream %v (%v/%v)", id, app, name)
+				http.Redirect(w, r, config.Prefix, http.StatusSeeOther)
+				return
+			}
+		}
+
+		state, err := store.Get()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		data := newTemplateData(r, store, config, state, errs)
+		err = templates.ExecuteTemplate(w, "form.html", data)
+		if err != nil {
+			log.Println("Template failed", err)
+		}
+	}
+}
+
+func TokenHandler(store *store.Store, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errs []error
+		var token string
+
+		expiry := parseExpiry(r.PostFormValue("auth_expire"))
+		if expiry == nil {
+			errs = append(errs, fmt.Errorf("invalid token expiry: '%v'", r.PostFormValue("auth_expire")))
+		}
+
+		app := r.PostFormValue("application")
+		name := r.PostFormValue("name")
+		if len(name) == 0 {
+			errs = append(errs, fmt.Errorf("stream name must be set"))
+		}
+
+		scope := r.PostFormValue("scope")
+
+		if !store.TokensEnabled() {
+			errs = append(errs, fmt.Errorf("signed tokens are disabled"))
+		}
+
+		if !getPermissions(r, config).CanEdit(app) {
+			errs = append(errs, errForbidden("sign tokens for", app))
+		}
+
+		if len(errs) == 0 {
+			var err error
+			token, err = store.SignToken(scope, app, name, *expiry)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to sign token: %w", err))
+			} else {
+				log.Printf("signed %v token for %v/%v", scope, app, name)
+			}
+		}
+
+		state, err := store.Get()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		data := newTemplateData(r, store, config, state, errs)
+		data.Token = token
+		data.TokenStream = scope + " " + app + "/" + name
 		err = templates.ExecuteTemplate(w, "form.html", data)
 		if err != nil {
 			log.Println("Template failed", err)
@@ -276,7 +505,13 @@ func RemoveHandler(store *store.Store, config ServerConfig) handleFunc {
 		var errs []error
 		id := r.PostFormValue("id")
 
-		err := store.RemoveStream(id)
+		stream, err := store.GetStream(id)
+		if err == nil && !getPermissions(r, config).CanEdit(stream.Application) {
+			err = errForbidden("remove", stream.Application)
+		}
+		if err == nil {
+			err = store.RemoveStream(id)
+		}
 		if err != nil {
 			log.Println(err)
 			errs = append(errs, fmt.Errorf("failed to remove stream: %w", err))
@@ -284,22 +519,88 @@ func RemoveHandler(store *store.Store, config ServerConfig) handleFunc {
 			if err != nil {
 				errs = append(errs, err)
 			}
-			data := TemplateData{
-				State:        state,
-				Config:       config,
-				CsrfTemplate: csrf.TemplateField(r),
-				Errors:       errs,
+			data := newTemplateData(r, store, config, state, errs)
+			err = templates.ExecuteTemplate(w, "form.html", data)
+			if err != nil {
+				log.Println("Template failed", err)
+			}
+		} else {
+			http.Redirect(w, r, config.Prefix, http.StatusSeeOther)
+		}
+	}
+}
+
+// keyHandler changes the keys of a stream after checking the edit permission
+func keyHandler(store *store.Store, config ServerConfig, action string, change func(r *http.Request, stream *storage.Stream) error) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errs []error
+		id := r.PostFormValue("id")
+
+		stream, err := store.GetStream(id)
+		if err == nil && !getPermissions(r, config).CanEdit(stream.Application) {
+			err = errForbidden("change keys of", stream.Application)
+		}
+		if err == nil {
+			err = change(r, stream)
+		}
+		if err != nil {
+			log.Println(err)
+			errs = append(errs, fmt.Errorf("failed to %s: %w", action, err))
+			state, err := store.Get()
+			if err != nil {
+				errs = append(errs, err)
 			}
+			data := newTemplateData(r, store, config, state, errs)
 			err = templates.ExecuteTemplate(w, "form.html", data)
 			if err != nil {
 				log.Println("Template failed", err)
 			}
 		} else {
+			log.Printf("%s of stream %v (%v/%v)", action, id, stream.Application, stream.Name)
 			http.Redirect(w, r, config.Prefix, http.StatusSeeOther)
 		}
 	}
 }
 
+func AddKeyHandler(store *store.Store, config ServerConfig) handleFunc {
+	return keyHandler(store, config, "add key", func(r *http.Request, stream *storage.Stream) error {
+		expiry := parseExpiry(r.PostFormValue("expire"))
+		if expiry == nil {
+			return fmt.Errorf("invalid key expiry: '%v'", r.PostFormValue("expire"))
+		}
+		return store.AddKey(stream.Id, &storage.Key{
+			Name:   r.PostFormValue("name"),
+			Key:    r.PostFormValue("key"),
+			Expire: *expiry,
+		})
+	})
+}
+
+func RemoveKeyHandler(store *store.Store, config ServerConfig) handleFunc {
+	return keyHandler(store, config, "remove key", func(r *http.Request, stream *storage.Stream) error {
+		return store.RemoveKey(stream.Id, r.PostFormValue("name"))
+	})
+}
+
+// RotateKeyHandler generates a new auth key, the previous key stays valid for the grace period
+func RotateKeyHandler(store *store.Store, config ServerConfig) handleFunc {
+	return keyHandler(store, config, "rotate key", func(r *http.Request, stream *storage.Stream) error {
+		expiry := parseExpiry(r.PostFormValue("grace"))
+		if expiry == nil {
+			return fmt.Errorf("invalid grace period: '%v'", r.PostFormValue("grace"))
+		}
+		// without grace period the previous key is invalid immediately
+		if *expiry == -1 {
+			*expiry = time.Now().Unix()
+		}
+		key, err := randomString()
+		if err != nil {
+			return err
+		}
+		return store.RotateKey(stream.Id, key, *expiry)
+	})
+}
+
 func BlockHandler(store *store.Store, config ServerConfig) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errs []error
@@ -325,19 +626,19 @@ func BlockHandler(store *store.Store, config ServerConfig) handleFunc {
 			}
 		}
 
-		err = store.SetBlocked(id, new)
-		if err != nil {
-			log.Println(err)
-			errs = append(errs, fmt.Errorf("failed to %v stream %v (%v/%v)", action, id, app, name))
+		if getPermissions(r, config).CanBlock(app) {
+			err = store.SetBlocked(id, new)
+			if err != nil {
+				log.Println(err)
+				errs = append(errs, fmt.Errorf("failed to %v stream %v (%v/%v)", action, id, app, name))
+			} else {
+				log.Printf("%ved Stream %v (%v/%v)", action, id, app, name)
+			}
+		} else {
+			errs = append(errs, errForbidden(action, app))
 		}
-		log.Printf("%ved Stream %v (%v/%v)", action, id, app, name)
 		if len(errs) > 0 {
-			data := TemplateData{
-				State:        state,
-				Config:       config,
-				CsrfTemplate: csrf.TemplateField(r),
-				Errors:       errs,
-			}
+			data := newTemplateData(r, store, config, state, errs)
 			err = templates.ExecuteTemplate(w, "form.html", data)
 			if err != nil {
 				log.Println("Template failed", err)
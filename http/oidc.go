@@ -0,0 +1,270 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig configures login through an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer       string `toml:"issuer"`
+	ClientID     string `toml:"client-id"`
+	ClientSecret string `toml:"client-secret" json:"-"`
+	// Public URL of the callback, e.g. https://example.org/<prefix>/oidc/callback
+	RedirectURL string   `toml:"redirect-url"`
+	Scopes      []string `toml:"scopes"`
+	// Claim used as user name, defaults to sub. Users are named "oidc:<claim>" in grants,
+	// only use claims which users can't change at the provider
+	UserClaim string `toml:"user-claim"`
+	// Claim containing the group list, defaults to groups
+	GroupsClaim string `toml:"groups-claim"`
+	// Only members of these groups may log in, empty allows every user of the provider
+	AllowedGroups []string `toml:"allowed-groups"`
+}
+
+const (
+	oidcCookie   = "rtmp-auth-oidc"
+	oidcLifetime = 10 * time.Minute
+)
+
+// oidcState binds an authorization request to the browser that started it
+type oidcState struct {
+	State   string
+	Nonce   string
+	Expires int64
+}
+
+// OIDCLogin implements the authorization code flow
+type OIDCLogin struct {
+	config OIDCConfig
+	auth   *Authenticator
+
+	mutex    sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func NewOIDCLogin(config OIDCConfig, auth *Authenticator) *OIDCLogin {
+	if config.UserClaim == "" {
+		config.UserClaim = "sub"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"profile", "email", "groups"}
+	}
+	return &OIDCLogin{config: config, auth: auth}
+}
+
+// Enabled returns whether an issuer is configured
+func (login *OIDCLogin) Enabled() bool {
+	return login.config.Issuer != ""
+}
+
+// setup runs provider discovery on first use, so the frontend starts even if the provider is unreachable
+func (login *OIDCLogin) setup(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	login.mutex.Lock()
+	defer login.mutex.Unlock()
+	if login.oauth != nil {
+		return login.oauth, login.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, login.config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	login.oauth = &oauth2.Config{
+		ClientID:     login.config.ClientID,
+		ClientSecret: login.config.ClientSecret,
+		RedirectURL:  login.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, login.config.Scopes...),
+	}
+	login.verifier = provider.Verifier(&oidc.Config{ClientID: login.config.ClientID})
+	return login.oauth, login.verifier, nil
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// allowed checks the group claim against the allowed groups
+func (login *OIDCLogin) allowed(groups []string) bool {
+	if len(login.config.AllowedGroups) == 0 {
+		return true
+	}
+	for _, allowed := range login.config.AllowedGroups {
+		for _, group := range groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// oidcUserPrefix separates provider users from local users of the same name
+const oidcUserPrefix = "oidc:"
+
+// parseClaims extracts user name and groups from the id token claims
+func (login *OIDCLogin) parseClaims(claims map[string]interface{}) (string, []string, error) {
+	user, _ := claims[login.config.UserClaim].(string)
+	if user == "" {
+		return "", nil, fmt.Errorf("id token contains no '%v' claim", login.config.UserClaim)
+	}
+	user = oidcUserPrefix + user
+
+	var groups []string
+	switch value := claims[login.config.GroupsClaim].(type) {
+	case string:
+		groups = []string{value}
+	case []interface{}:
+		for _, group := range value {
+			if str, ok := group.(string); ok {
+				groups = append(groups, str)
+			}
+		}
+	}
+	return user, groups, nil
+}
+
+func (login *OIDCLogin) fail(w http.ResponseWriter, r *http.Request, err error) {
+	log.Println("oidc login failed:", err)
+	renderLogin(w, r, login.auth, []error{fmt.Errorf("login failed: %w", err)})
+}
+
+// LoginHandler redirects to the provider
+func (login *OIDCLogin) LoginHandler() handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		oauth, _, err := login.setup(ctx)
+		if err != nil {
+			login.fail(w, r, err)
+			return
+		}
+
+		state, err := randomString()
+		if err != nil {
+			login.fail(w, r, err)
+			return
+		}
+		nonce, err := randomString()
+		if err != nil {
+			login.fail(w, r, err)
+			return
+		}
+
+		pending := &oidcState{
+			State:   state,
+			Nonce:   nonce,
+			Expires: time.Now().Add(oidcLifetime).Unix(),
+		}
+		value, err := login.auth.codec.Encode(oidcCookie, pending)
+		if err != nil {
+			login.fail(w, r, err)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcCookie,
+			Value:    value,
+			Path:     login.auth.cookiePath(),
+			Expires:  time.Unix(pending.Expires, 0),
+			Secure:   !login.auth.config.Insecure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, oauth.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+	}
+}
+
+// CallbackHandler completes the login after the provider redirected back
+func (login *OIDCLogin) CallbackHandler() handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		oauth, verifier, err := login.setup(ctx)
+		if err != nil {
+			login.fail(w, r, err)
+			return
+		}
+
+		if msg := r.URL.Query().Get("error"); msg != "" {
+			login.fail(w, r, fmt.Errorf("provider: %v %v", msg, r.URL.Query().Get("error_description")))
+			return
+		}
+
+		cookie, err := r.Cookie(oidcCookie)
+		if err != nil {
+			login.fail(w, r, errors.New("missing login state"))
+			return
+		}
+		var pending oidcState
+		if err := login.auth.codec.Decode(oidcCookie, cookie.Value, &pending); err != nil {
+			login.fail(w, r, errors.New("invalid login state"))
+			return
+		}
+		if pending.Expires < time.Now().Unix() || r.URL.Query().Get("state") != pending.State {
+			login.fail(w, r, errors.New("login state mismatch"))
+			return
+		}
+
+		token, err := oauth.Exchange(ctx, r.URL.Query().Get("code"))
+		if err != nil {
+			login.fail(w, r, fmt.Errorf("code exchange: %w", err))
+			return
+		}
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			login.fail(w, r, errors.New("no id token in response"))
+			return
+		}
+		idToken, err := verifier.Verify(ctx, rawIDToken)
+		if err != nil {
+			login.fail(w, r, fmt.Errorf("verify id token: %w", err))
+			return
+		}
+		if idToken.Nonce != pending.Nonce {
+			login.fail(w, r, errors.New("nonce mismatch"))
+			return
+		}
+
+		var claims map[string]interface{}
+		if err := idToken.Claims(&claims); err != nil {
+			login.fail(w, r, fmt.Errorf("parse claims: %w", err))
+			return
+		}
+		user, groups, err := login.parseClaims(claims)
+		if err != nil {
+			login.fail(w, r, err)
+			return
+		}
+		if !login.allowed(groups) {
+			log.Printf("oidc user '%v' not in allowed groups %v", user, groups)
+			renderLogin(w, r, login.auth, []error{fmt.Errorf("user '%v' is not allowed to access this page", user)})
+			return
+		}
+
+		if err := login.auth.setSession(w, &Session{User: user, Groups: groups}); err != nil {
+			login.fail(w, r, err)
+			return
+		}
+		log.Printf("oidc user '%v' logged in", user)
+		http.Redirect(w, r, login.auth.config.Prefix+"/", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,206 @@
+package http
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const oidcTestClient = "rtmp-auth"
+
+// mockIssuer is an OpenID Connect provider serving discovery, JWKS and the token endpoint
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	// claims of the next id token
+	claims map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("code") != "test-code" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.sign(t, issuer.claims),
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+// sign creates an RS256 JWT
+func (issuer *mockIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, issuer.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+
+	tests := []struct {
+		name          string
+		allowedGroups []string
+		groups        []string
+		// state and nonce replace the values of the login redirect if set
+		state   string
+		nonce   string
+		noState bool
+		status  int
+		user    string
+		err     string
+	}{
+		{name: "login", groups: []string{"streaming"}, status: http.StatusSeeOther, user: "oidc:user-1"},
+		{name: "allowed group", allowedGroups: []string{"streaming"}, groups: []string{"other", "streaming"}, status: http.StatusSeeOther, user: "oidc:user-1"},
+		{name: "not in allowed groups", allowedGroups: []string{"streaming"}, groups: []string{"other"}, status: http.StatusUnauthorized, err: "is not allowed to access this page"},
+		{name: "no groups", allowedGroups: []string{"streaming"}, status: http.StatusUnauthorized, err: "is not allowed to access this page"},
+		{name: "state mismatch", state: "forged", status: http.StatusUnauthorized, err: "login state mismatch"},
+		{name: "missing state cookie", noState: true, status: http.StatusUnauthorized, err: "missing login state"},
+		{name: "nonce mismatch", nonce: "replayed", status: http.StatusUnauthorized, err: "nonce mismatch"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := ServerConfig{
+				Insecure: true,
+				OIDC: OIDCConfig{
+					Issuer:        issuer.URL,
+					ClientID:      oidcTestClient,
+					ClientSecret:  "client-secret",
+					RedirectURL:   "http://rtmp-auth.example/oidc/callback",
+					AllowedGroups: test.allowedGroups,
+				},
+			}
+			auth := NewAuthenticator(config, []byte("secret"))
+
+			// login redirects to the provider with state and nonce
+			w := httptest.NewRecorder()
+			auth.OIDC.LoginHandler()(w, httptest.NewRequest("GET", "/oidc/login", nil))
+			if w.Code != http.StatusFound {
+				t.Fatalf("login status = %v, want %v: %s", w.Code, http.StatusFound, w.Body)
+			}
+			redirect, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(redirect.String(), issuer.URL+"/authorize") {
+				t.Fatalf("redirect to %v", redirect)
+			}
+			state, nonce := redirect.Query().Get("state"), redirect.Query().Get("nonce")
+			if state == "" || nonce == "" {
+				t.Fatalf("redirect without state or nonce: %v", redirect)
+			}
+			if test.state != "" {
+				state = test.state
+			}
+			if test.nonce != "" {
+				nonce = test.nonce
+			}
+
+			now := time.Now()
+			issuer.claims = map[string]interface{}{
+				"iss":                issuer.URL,
+				"aud":                oidcTestClient,
+				"sub":                "user-1",
+				"preferred_username": "admin",
+				"iat":                now.Unix(),
+				"exp":                now.Add(time.Minute).Unix(),
+				"nonce":              nonce,
+			}
+			if test.groups != nil {
+				issuer.claims["groups"] = test.groups
+			}
+
+			// the provider redirects back with the code
+			query := url.Values{"code": {"test-code"}, "state": {state}}
+			r := httptest.NewRequest("GET", "/oidc/callback?"+query.Encode(), nil)
+			if !test.noState {
+				for _, cookie := range w.Result().Cookies() {
+					r.AddCookie(cookie)
+				}
+			}
+			w = httptest.NewRecorder()
+			auth.OIDC.CallbackHandler()(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("callback status = %v, want %v: %s", w.Code, test.status, w.Body)
+			}
+			if test.err != "" && !strings.Contains(w.Body.String(), test.err) {
+				t.Errorf("response does not contain %q", test.err)
+			}
+
+			var session *Session
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == sessionCookie {
+					r := httptest.NewRequest("GET", "/", nil)
+					r.AddCookie(cookie)
+					session = auth.readSession(r)
+				}
+			}
+			if test.user == "" {
+				if session != nil {
+					t.Errorf("failed login created session for %v", session.User)
+				}
+				return
+			}
+			if session == nil {
+				t.Fatal("no session after login")
+			}
+			if session.User != test.user {
+				t.Errorf("user = %v, want %v", session.User, test.user)
+			}
+		})
+	}
+}
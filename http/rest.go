@@ -0,0 +1,470 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/voc/rtmp-auth/storage"
+	"github.com/voc/rtmp-auth/store"
+)
+
+// StreamResource is the JSON representation of a stream in the REST API
+type StreamResource struct {
+	Id          string `json:"id"`
+	Application string `json:"application"`
+	Vhost       string `json:"vhost"`
+	Name        string `json:"name"`
+	AuthKey     string `json:"auth_key"`
+	PlayKey     string `json:"play_key"`
+	AuthExpire  int64  `json:"auth_expire"`
+	Notes       string `json:"notes"`
+	Blocked     bool   `json:"blocked"`
+	Expired     bool   `json:"expired"`
+	Active      bool   `json:"active"`
+	// Keys are additional named publish keys
+	Keys []KeyResource `json:"keys"`
+	// Session is set while the stream is active
+	Session *SessionResource `json:"session,omitempty"`
+}
+
+// SessionResource describes the active publish of a stream
+type SessionResource struct {
+	ClientIP string `json:"client_ip"`
+	Started  int64  `json:"started"`
+	Server   string `json:"server"`
+	TcURL    string `json:"tc_url"`
+}
+
+// KeyResource is a named publish key, valid until expire (-1 for never)
+type KeyResource struct {
+	Name   string      `json:"name"`
+	Key    string      `json:"key"`
+	Expire expiryValue `json:"expire"`
+}
+
+func newStreamResource(stream *storage.Stream) StreamResource {
+	keys := make([]KeyResource, 0, len(stream.Keys))
+	for _, key := range stream.Keys {
+		keys = append(keys, KeyResource{Name: key.Name, Key: key.Key, Expire: expiryValue(key.Expire)})
+	}
+	var session *SessionResource
+	if stream.Session != nil {
+		session = &SessionResource{
+			ClientIP: stream.Session.ClientIp,
+			Started:  stream.Session.Started,
+			Server:   stream.Session.Server,
+			TcURL:    stream.Session.TcUrl,
+		}
+	}
+	return StreamResource{
+		Id:          stream.Id,
+		Application: stream.Application,
+		Vhost:       stream.Vhost,
+		Name:        stream.Name,
+		AuthKey:     stream.AuthKey,
+		Keys:        keys,
+		PlayKey:     stream.PlayKey,
+		AuthExpire:  stream.AuthExpire,
+		Notes:       stream.Notes,
+		Blocked:     stream.Blocked,
+		Expired:     stream.Expired,
+		Active:      stream.Active,
+		Session:     session,
+	}
+}
+
+// expiryValue accepts either a unix timestamp (-1 for never)
+// or the same duration/time strings as the web form
+type expiryValue int64
+
+func (e *expiryValue) UnmarshalJSON(data []byte) error {
+	var timestamp int64
+	if err := json.Unmarshal(data, &timestamp); err == nil {
+		*e = expiryValue(timestamp)
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("auth_expire must be a number or string")
+	}
+	expiry := parseExpiry(str)
+	if expiry == nil {
+		return fmt.Errorf("invalid auth expiry: '%v'", str)
+	}
+	*e = expiryValue(*expiry)
+	return nil
+}
+
+// graceValue is the end of a grace period, given in seconds
+// or as the same duration/time strings as the web form
+type graceValue int64
+
+func (g *graceValue) UnmarshalJSON(data []byte) error {
+	var seconds int64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		if seconds < 0 {
+			return fmt.Errorf("grace must not be negative")
+		}
+		*g = graceValue(time.Now().Unix() + seconds)
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("grace must be a number or string")
+	}
+	expiry := parseExpiry(str)
+	if expiry == nil {
+		return fmt.Errorf("invalid grace: '%v'", str)
+	}
+	*g = graceValue(*expiry)
+	return nil
+}
+
+// streamRequest is the body of create and update requests,
+// fields which are not set are left unchanged on update
+type streamRequest struct {
+	Application *string      `json:"application"`
+	Vhost       *string      `json:"vhost"`
+	Name        *string      `json:"name"`
+	AuthKey     *string      `json:"auth_key"`
+	PlayKey     *string      `json:"play_key"`
+	AuthExpire  *expiryValue `json:"auth_expire"`
+	Notes       *string      `json:"notes"`
+	// Keys replaces all additional keys if set
+	Keys *[]keyRequest `json:"keys"`
+}
+
+// keyRequest is an additional key of a stream request, keys without expire never expire
+type keyRequest struct {
+	Name   string       `json:"name"`
+	Key    string       `json:"key"`
+	Expire *expiryValue `json:"expire"`
+}
+
+// apply copies all set fields to the stream
+func (req *streamRequest) apply(stream *storage.Stream) {
+	if req.Application != nil {
+		stream.Application = *req.Application
+	}
+	if req.Vhost != nil {
+		stream.Vhost = *req.Vhost
+	}
+	if req.Name != nil {
+		stream.Name = *req.Name
+	}
+	if req.AuthKey != nil {
+		stream.AuthKey = *req.AuthKey
+	}
+	if req.Keys != nil {
+		stream.Keys = make([]*storage.Key, 0, len(*req.Keys))
+		for _, key := range *req.Keys {
+			expire := int64(-1)
+			if key.Expire != nil {
+				expire = int64(*key.Expire)
+			}
+			stream.Keys = append(stream.Keys, &storage.Key{Name: key.Name, Key: key.Key, Expire: expire})
+		}
+	}
+	if req.PlayKey != nil {
+		stream.PlayKey = *req.PlayKey
+	}
+	if req.AuthExpire != nil {
+		stream.AuthExpire = int64(*req.AuthExpire)
+	}
+	if req.Notes != nil {
+		stream.Notes = *req.Notes
+	}
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("api: encode response", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// statusError carries the response status of an error returned from within a store update
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// writeStoreError maps store errors to a matching status code
+func writeStoreError(w http.ResponseWriter, err error) {
+	var se *statusError
+	if errors.As(err, &se) {
+		writeError(w, se.status, se.err)
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Println("api:", err)
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func decodeStreamRequest(r *http.Request) (*streamRequest, error) {
+	defer r.Body.Close()
+	var req streamRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+	return &req, nil
+}
+
+// validateStream checks a stream before it is written to the store
+func validateStream(stream *storage.Stream, config ServerConfig) error {
+	if len(stream.Name) == 0 {
+		return fmt.Errorf("stream name must be set")
+	}
+	if err := validateVhost(stream.Vhost, config); err != nil {
+		return err
+	}
+	if err := store.ValidateKeys(stream.Keys); err != nil {
+		return err
+	}
+	if len(config.Applications) == 0 {
+		return nil
+	}
+	for _, app := range config.Applications {
+		if app == stream.Application {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown application '%v'", stream.Application)
+}
+
+// validateVhost checks the vhost of a stream against the configured vhosts,
+// the empty vhost matching all vhosts is always valid
+func validateVhost(vhost string, config ServerConfig) error {
+	if vhost == "" || len(config.VHosts) == 0 {
+		return nil
+	}
+	for _, allowed := range config.VHosts {
+		if allowed == vhost {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown vhost '%v'", vhost)
+}
+
+// permission checks a role of Permissions on an application
+type permission func(perms Permissions, app string) bool
+
+// authorizedStream returns the stream of the request if the user has the permission on its application,
+// otherwise writes the error response and returns nil
+func authorizedStream(w http.ResponseWriter, r *http.Request, store *store.Store, config ServerConfig, allowed permission, action string) *storage.Stream {
+	stream, err := store.GetStream(mux.Vars(r)["id"])
+	if err != nil {
+		writeStoreError(w, err)
+		return nil
+	}
+	if !allowed(getPermissions(r, config), stream.Application) {
+		writeError(w, http.StatusForbidden, errForbidden(action, stream.Application))
+		return nil
+	}
+	return stream
+}
+
+func ListStreamsHandler(store *store.Store, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, err := store.Get()
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		perms := getPermissions(r, config)
+		streams := make([]StreamResource, 0, len(state.Streams))
+		for _, stream := range state.Streams {
+			if perms.CanView(stream.Application) {
+				streams = append(streams, newStreamResource(stream))
+			}
+		}
+		writeJSON(w, http.StatusOK, streams)
+	}
+}
+
+func GetStreamHandler(store *store.Store, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stream := authorizedStream(w, r, store, config, Permissions.CanView, "view")
+		if stream == nil {
+			return
+		}
+		writeJSON(w, http.StatusOK, newStreamResource(stream))
+	}
+}
+
+func CreateStreamHandler(store *store.Store, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeStreamRequest(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		stream := &storage.Stream{AuthExpire: -1}
+		req.apply(stream)
+		if !getPermissions(r, config).CanEdit(stream.Application) {
+			writeError(w, http.StatusForbidden, errForbidden("add", stream.Application))
+			return
+		}
+		if err := validateStream(stream, config); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		if err := store.AddStream(stream); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		log.Printf("api: added stream %v (%v/%v)", stream.Id, stream.Application, stream.Name)
+		writeJSON(w, http.StatusCreated, newStreamResource(stream))
+	}
+}
+
+func UpdateStreamHandler(store *store.Store, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeStreamRequest(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// editing requires admin on the previous and the new application
+		perms := getPermissions(r, config)
+		stream, err := store.UpdateStream(mux.Vars(r)["id"], func(stream *storage.Stream) error {
+			if !perms.CanEdit(stream.Application) {
+				return &statusError{http.StatusForbidden, errForbidden("edit", stream.Application)}
+			}
+			req.apply(stream)
+			if !perms.CanEdit(stream.Application) {
+				return &statusError{http.StatusForbidden, errForbidden("edit", stream.Application)}
+			}
+			if err := validateStream(stream, config); err != nil {
+				return &statusError{http.StatusUnprocessableEntity, err}
+			}
+			return nil
+		})
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		log.Printf("api: updated stream %v (%v/%v)", stream.Id, stream.Application, stream.Name)
+		writeJSON(w, http.StatusOK, newStreamResource(stream))
+	}
+}
+
+func DeleteStreamHandler(store *store.Store, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stream := authorizedStream(w, r, store, config, Permissions.CanEdit, "remove")
+		if stream == nil {
+			return
+		}
+		id := stream.Id
+		if err := store.RemoveStream(id); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		log.Printf("api: removed stream %v", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type rotateRequest struct {
+	// Grace is the time the previous key stays valid
+	Grace *graceValue `json:"grace"`
+}
+
+// RotateStreamHandler generates a new auth key, the previous key stays valid until the grace period ends
+func RotateStreamHandler(store *store.Store, config ServerConfig) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorizedStream(w, r, store, config, Permissions.CanEdit, "change keys of") == nil {
+			return
+		}
+		defer r.Body.Close()
+		// an empty body rotates without grace period
+		var req rotateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+		expire := time.Now().Unix()
+		if req.Grace != nil && *req.Grace != -1 {
+			expire = int64(*req.Grace)
+		}
+
+		key, err := randomString()
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		id := mux.Vars(r)["id"]
+		if err := store.RotateKey(id, key, expire); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		stream, err := store.GetStream(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		log.Printf("api: rotated key of stream %v (%v/%v)", id, stream.Application, stream.Name)
+		writeJSON(w, http.StatusOK, newStreamResource(stream))
+	}
+}
+
+func BlockStreamHandler(store *store.Store, config ServerConfig, blocked bool) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := "block"
+		if !blocked {
+			action = "unblock"
+		}
+		stream := authorizedStream(w, r, store, config, Permissions.CanBlock, action)
+		if stream == nil {
+			return
+		}
+		id := stream.Id
+		if err := store.SetBlocked(id, blocked); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		stream, err := store.GetStream(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		log.Printf("api: set stream %v (%v/%v) blocked=%v", id, stream.Application, stream.Name, blocked)
+		writeJSON(w, http.StatusOK, newStreamResource(stream))
+	}
+}
@@ -0,0 +1,127 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Role defines what a frontend user may do with the streams of an application
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleViewer may see streams
+	RoleViewer
+	// RoleOperator may additionally block and unblock streams
+	RoleOperator
+	// RoleAdmin may additionally add, edit and remove streams and sign tokens
+	RoleAdmin
+)
+
+func ParseRole(name string) (Role, error) {
+	switch name {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return RoleNone, fmt.Errorf("unknown role '%v'", name)
+	}
+}
+
+// GrantConfig assigns a role on applications to users or groups
+type GrantConfig struct {
+	Role   string   `toml:"role"`
+	Users  []string `toml:"users"`
+	Groups []string `toml:"groups"`
+	// Applications the role applies to, empty for all applications
+	Applications []string `toml:"applications"`
+}
+
+// matches returns whether the grant applies to a session
+func (grant GrantConfig) matches(session *Session) bool {
+	for _, user := range grant.Users {
+		if user == session.User {
+			return true
+		}
+	}
+	for _, group := range grant.Groups {
+		for _, member := range session.Groups {
+			if group == member {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Permissions holds the roles of a frontend user
+type Permissions struct {
+	// role on every application
+	all  Role
+	apps map[string]Role
+}
+
+// getPermissions computes the permissions for the session of a request.
+// Without login or without any grants configured every user is admin.
+func getPermissions(r *http.Request, config ServerConfig) Permissions {
+	session := getSession(r)
+	if session == nil || len(config.Grants) == 0 {
+		return Permissions{all: RoleAdmin}
+	}
+
+	perms := Permissions{apps: make(map[string]Role)}
+	for _, grant := range config.Grants {
+		if !grant.matches(session) {
+			continue
+		}
+		// roles are validated on startup
+		role, _ := ParseRole(grant.Role)
+		if len(grant.Applications) == 0 && role > perms.all {
+			perms.all = role
+		}
+		for _, app := range grant.Applications {
+			if role > perms.apps[app] {
+				perms.apps[app] = role
+			}
+		}
+	}
+	return perms
+}
+
+// Role returns the highest role on an application
+func (perms Permissions) Role(app string) Role {
+	if role := perms.apps[app]; role > perms.all {
+		return role
+	}
+	return perms.all
+}
+
+func (perms Permissions) CanView(app string) bool {
+	return perms.Role(app) >= RoleViewer
+}
+
+func (perms Permissions) CanBlock(app string) bool {
+	return perms.Role(app) >= RoleOperator
+}
+
+func (perms Permissions) CanEdit(app string) bool {
+	return perms.Role(app) >= RoleAdmin
+}
+
+// Editable filters the applications on which streams may be added
+func (perms Permissions) Editable(apps []string) []string {
+	var res []string
+	for _, app := range apps {
+		if perms.CanEdit(app) {
+			res = append(res, app)
+		}
+	}
+	return res
+}
+
+func errForbidden(action string, app string) error {
+	return fmt.Errorf("not allowed to %v streams in application '%v'", action, app)
+}
@@ -11,14 +11,40 @@ import (
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	"github.com/rakyll/statik/fs"
+	"github.com/voc/rtmp-auth/ingest"
 	_ "github.com/voc/rtmp-auth/statik"
 	"github.com/voc/rtmp-auth/store"
 )
 
 type ServerConfig struct {
 	Applications []string `toml:"applications"`
-	Prefix       string   `toml:"prefix"`
-	Insecure     bool     `toml:"insecure"`
+	// SRS vhosts streams can be restricted to, streams without vhost match all vhosts
+	VHosts   []string `toml:"vhosts"`
+	Prefix   string   `toml:"prefix"`
+	Insecure bool     `toml:"insecure"`
+	// Ordered key sources per application, "*" applies to applications without own sources.
+	// Only the ?auth= parameter (or the MediaMTX password) is used if empty.
+	KeySources map[string][]string `toml:"key-sources"`
+	// Applications in which publishers use their auth key as stream name,
+	// the publish is renamed to the public stream name
+	KeyAsName []string `toml:"key-as-name"`
+	// Applications which may be played without play key
+	PublicPlayback []string `toml:"public-playback"`
+	// Authenticate players on all callback routes, not only on /play
+	PlayAuth bool `toml:"play-auth"`
+
+	// Local users allowed to log into the frontend, login is disabled if empty
+	Users []UserConfig `toml:"users"`
+	// OpenID Connect login, disabled if no issuer is set
+	OIDC OIDCConfig `toml:"oidc"`
+	// Roles of logged in users, every user is admin if empty
+	Grants []GrantConfig `toml:"grants"`
+	// Bearer tokens for scripted access to the JSON API
+	APITokens []APITokenConfig `toml:"api-tokens"`
+	// Adapter for the /publish, /unpublish, /play and /update callbacks, detected from the request if empty
+	Ingest string `toml:"ingest"`
+	// OvenMediaEngine admission webhook
+	OME ingest.OMEConfig `toml:"ome"`
 }
 
 type Frontend struct {
@@ -31,23 +57,52 @@ func NewFrontend(address string, config ServerConfig, store *store.Store) *Front
 	if err != nil {
 		log.Fatal("get", err)
 	}
+	for _, grant := range config.Grants {
+		if _, err := ParseRole(grant.Role); err != nil {
+			log.Fatal("grants: ", err)
+		}
+	}
 	CSRF := csrf.Protect(state.Secret, csrf.Secure(!config.Insecure))
 	statikFS, err := fs.New()
 	if err != nil {
 		log.Fatal(err)
 	}
+	auth := NewAuthenticator(config, state.Secret)
 	router := mux.NewRouter()
+	router.Use(auth.Middleware)
 	sub := router.PathPrefix(config.Prefix).Subrouter()
+	sub.Path("/login").Methods("GET").HandlerFunc(LoginFormHandler(auth))
+	sub.Path("/login").Methods("POST").HandlerFunc(LoginHandler(auth, config))
+	sub.Path("/oidc/login").Methods("GET").HandlerFunc(auth.OIDC.LoginHandler())
+	sub.Path("/oidc/callback").Methods("GET").HandlerFunc(auth.OIDC.CallbackHandler())
+	sub.Path("/logout").Methods("POST").HandlerFunc(LogoutHandler(auth, config))
 	sub.Path("/").Methods("GET").HandlerFunc(FormHandler(store, config))
 	sub.Path("/add").Methods("POST").HandlerFunc(AddHandler(store, config))
+	sub.Path("/edit").Methods("POST").HandlerFunc(EditHandler(store, config))
+	sub.Path("/token").Methods("POST").HandlerFunc(TokenHandler(store, config))
 	sub.Path("/remove").Methods("POST").HandlerFunc(RemoveHandler(store, config))
+	sub.Path("/addkey").Methods("POST").HandlerFunc(AddKeyHandler(store, config))
+	sub.Path("/removekey").Methods("POST").HandlerFunc(RemoveKeyHandler(store, config))
+	sub.Path("/rotate").Methods("POST").HandlerFunc(RotateKeyHandler(store, config))
 	sub.Path("/block").Methods("POST").HandlerFunc(BlockHandler(store, config))
+
+	// JSON stream management, authenticated by login session or API token
+	v1 := sub.PathPrefix("/v1").Subrouter()
+	v1.Path("/streams").Methods("GET").HandlerFunc(ListStreamsHandler(store, config))
+	v1.Path("/streams").Methods("POST").HandlerFunc(CreateStreamHandler(store, config))
+	v1.Path("/streams/{id}").Methods("GET").HandlerFunc(GetStreamHandler(store, config))
+	v1.Path("/streams/{id}").Methods("PATCH").HandlerFunc(UpdateStreamHandler(store, config))
+	v1.Path("/streams/{id}").Methods("DELETE").HandlerFunc(DeleteStreamHandler(store, config))
+	v1.Path("/streams/{id}/block").Methods("POST").HandlerFunc(BlockStreamHandler(store, config, true))
+	v1.Path("/streams/{id}/unblock").Methods("POST").HandlerFunc(BlockStreamHandler(store, config, false))
+	v1.Path("/streams/{id}/rotate").Methods("POST").HandlerFunc(RotateStreamHandler(store, config))
+
 	sub.PathPrefix("/public/").Handler(
 		http.StripPrefix(config.Prefix+"/public/", http.FileServer(statikFS)))
 
 	frontend := &Frontend{
 		server: &http.Server{
-			Handler:      CSRF(router),
+			Handler:      auth.TokenMiddleware(CSRF(router)),
 			Addr:         address,
 			WriteTimeout: 15 * time.Second,
 			ReadTimeout:  15 * time.Second,
@@ -80,9 +135,37 @@ type API struct {
 }
 
 func NewAPI(address string, config ServerConfig, store *store.Store) *API {
+	adapters := ingest.NewRegistry()
+	adapters.Register("nginx", ingest.NginxAdapter{})
+	adapters.Register("srtrelay", ingest.SRTRelayAdapter{})
+	adapters.Register("srs", ingest.SRSAdapter{})
+	adapters.Register("mediamtx", ingest.MediaMTXAdapter{})
+	adapters.Register("ome", ingest.NewOMEAdapter(config.OME))
+	if _, ok := adapters.Get(config.Ingest); config.Ingest != "" && !ok {
+		log.Fatalf("ingest: unknown adapter '%v', available: %v", config.Ingest, adapters.Names())
+	}
+
+	keySources := make(map[string][]ingest.KeySource)
+	for app, specs := range config.KeySources {
+		sources, err := ingest.ParseKeySources(specs)
+		if err != nil {
+			log.Fatalf("key-sources for %v: %v", app, err)
+		}
+		keySources[app] = sources
+	}
+
 	router := mux.NewRouter()
-	router.Path("/publish").Methods("POST").HandlerFunc(PublishHandler(store))
-	router.Path("/unpublish").Methods("POST").HandlerFunc(UnpublishHandler(store))
+	// players are always authenticated on /play, on other routes only if enabled,
+	// as servers with a single callback url send play requests there too
+	ingestHandler := IngestHandler(store, config, adapters, keySources, config.PlayAuth)
+	for _, path := range []string{"/publish", "/unpublish", "/update"} {
+		router.Path(path).Methods("POST").HandlerFunc(ingestHandler)
+	}
+	router.Path("/play").Methods("POST").HandlerFunc(IngestHandler(store, config, adapters, keySources, true))
+	router.Path("/heartbeat").Methods("POST").HandlerFunc(HeartbeatHandler(store))
+
+	// callbacks of a specific ingest server, e.g. /srs or /mediamtx
+	router.Path("/{adapter}").Methods("POST").HandlerFunc(ingestHandler)
 
 	api := &API{
 		server: &http.Server{
@@ -2,18 +2,40 @@ package http
 
 import (
 	"html/template"
+	"time"
 
 	"github.com/voc/rtmp-auth/storage"
 )
 
 type TemplateData struct {
+	User         string
+	Perms        Permissions
 	State        *storage.State
 	Config       ServerConfig
 	CsrfTemplate template.HTML
 	Errors       []error
+	Tokens       bool
+	Token        string
+	TokenStream  string
 }
 
-var templates = template.Must(template.New("form.html").Parse(
+// formatExpiry formats an expiry timestamp for the edit form
+func formatExpiry(expiry int64) string {
+	if expiry == -1 {
+		return ""
+	}
+	return time.Unix(expiry, 0).Format(time.RFC3339)
+}
+
+// formatTime formats a timestamp for display
+func formatTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).Format("2006-01-02 15:04:05")
+}
+
+var templates = template.Must(template.New("form.html").Funcs(template.FuncMap{
+	"formatExpiry": formatExpiry,
+	"formatTime":   formatTime,
+}).Parse(
 	`<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -26,6 +48,13 @@ var templates = template.Must(template.New("form.html").Parse(
 <body>
   <div class="container">
     <h1><a href="{{$.Config.Prefix}}">rtmp-auth</a></h1>
+    {{if .User}}
+      <form class="inline logout" action="{{$.Config.Prefix}}/logout" method="POST">
+        {{ $.CsrfTemplate }}
+        <span>{{.User}}</span>
+        <button class="secondary">Logout</button>
+      </form>
+    {{end}}
     <h2>Streams</h2>
 
     <div class="row">
@@ -43,6 +72,7 @@ var templates = template.Must(template.New("form.html").Parse(
       <thead>
         <th>Name</th>
         <th data-label="Auth">Auth</th>
+        <th data-label="Play">Play</th>
         <th data-label="Blocked">Blocked</th>
         <th>Expires</th>
         <th data-label="Notes">Notes</th>
@@ -53,19 +83,43 @@ var templates = template.Must(template.New("form.html").Parse(
         <tr>
           <td data-label="Name">
             {{.Application}}/{{.Name}}
+            {{with .Vhost}}
+              <mark class="tag tertiary" title="vhost">{{.}}</mark>
+            {{end}}
             {{if .Active}}
               <mark class="tag">live</mark>
+              {{with .Session}}
+                <small class="session" title="{{.TcUrl}}">
+                  {{.ClientIp}} via {{.Server}} since {{formatTime .Started}}
+                </small>
+              {{end}}
+            {{end}}
+            {{if .Expired}}
+              <mark class="tag secondary">expired</mark>
             {{end}}
           </td>
           <td data-label="Auth">
             <input class="authKey" size="5" value="{{.AuthKey}}" readonly/><button class="secondary copyToClipboard inputAddon">Copy</button>
+            {{range .Keys}}
+              <div class="extraKey">
+                <small>{{.Name}}{{if ne .Expire -1}} until {{formatTime .Expire}}{{end}}</small>
+                <input class="authKey" size="5" value="{{.Key}}" readonly/><button class="secondary copyToClipboard inputAddon">Copy</button>
+              </div>
+            {{end}}
+          </td>
+          <td data-label="Play">
+            {{if .PlayKey}}
+              <input class="authKey" size="5" value="{{.PlayKey}}" readonly/><button class="secondary copyToClipboard inputAddon">Copy</button>
+            {{else}}
+              public
+            {{end}}
           </td>
           <td data-label="Blocked">
             <form class="inline" action="{{$.Config.Prefix}}/block" method="POST" novalidate>
               {{ $.CsrfTemplate }}
               <input type="hidden" name="id" value="{{.Id}}">
               <input type="hidden" name="blocked" value="{{.Blocked}}">
-              <input type="checkbox" oninput="this.form.submit();"{{if eq .Blocked true}} checked{{end}}>
+              <input type="checkbox" oninput="this.form.submit();"{{if eq .Blocked true}} checked{{end}}{{if not ($.Perms.CanBlock .Application)}} disabled{{end}}>
             </form>
           </td>
           <td data-label="Expire" data-expire="{{.AuthExpire}}">
@@ -77,29 +131,167 @@ var templates = template.Must(template.New("form.html").Parse(
           </td>
           <td data-label="Notes">{{.Notes}}</td>
           <td style="text-align:right;">
+            {{if $.Perms.CanEdit .Application}}
+            <button class="secondary editStream">Edit</button>
             <form class="inline" action="{{$.Config.Prefix}}/remove" method="POST">
               {{ $.CsrfTemplate }}
               <input type="hidden" name="id" value="{{.Id}}">
               <button class="secondary">Remove</button>
             </form>
+            {{end}}
+          </td>
+        </tr>
+        {{if $.Perms.CanEdit .Application}}
+        <tr class="editRow" hidden>
+          <td colspan="7">
+            <form class="addForm" action="{{$.Config.Prefix}}/edit" method="POST" novalidate>
+              <input type="hidden" name="id" value="{{.Id}}">
+              <div class="row">
+                <div class="col-sm-12 col-md-6">
+                  <label for="application-{{.Id}}">Application</label>
+                  <select type="text" id="application-{{.Id}}" name="application">
+                    {{$app := .Application}}
+                    {{range $.Perms.Editable $.Config.Applications}}
+                      <option value="{{.}}"{{if eq . $app}} selected{{end}}>{{.}}</option>
+                    {{end}}
+                  </select>
+                </div>
+
+                {{if $.Config.VHosts}}
+                <div class="col-sm-12 col-md-6">
+                  <label for="vhost-{{.Id}}">VHost</label>
+                  <select type="text" id="vhost-{{.Id}}" name="vhost">
+                    {{$vhost := .Vhost}}
+                    <option value="">all</option>
+                    {{range $.Config.VHosts}}
+                      <option value="{{.}}"{{if eq . $vhost}} selected{{end}}>{{.}}</option>
+                    {{end}}
+                  </select>
+                </div>
+                {{end}}
+
+                <div class="col-sm-12 col-md-6">
+                  <label for="stream-{{.Id}}">Stream</label>
+                  <input type="text" size="5" id="stream-{{.Id}}" name="name" value="{{.Name}}">
+                </div>
+
+                <div class="col-sm-12 col-md-6">
+                  <label for="authKey-{{.Id}}">Auth Key</label>
+                  <input type="text" size="3" id="authKey-{{.Id}}" name="auth_key" value="{{.AuthKey}}" placeholder="no auth"><button class="secondary generateKey inputAddon">Generate key</button>
+                </div>
+
+                <div class="col-sm-12 col-md-6">
+                  <label for="playKey-{{.Id}}">Play Key</label>
+                  <input type="text" size="3" id="playKey-{{.Id}}" name="play_key" value="{{.PlayKey}}" placeholder="public"><button class="secondary generateKey inputAddon">Generate key</button>
+                </div>
+
+                <div class="col-sm-12 col-md-6">
+                  <label for="authExpire-{{.Id}}">Auth Expire</label>
+                  <input type="text" size="5" id="authExpire-{{.Id}}" name="auth_expire" value="{{formatExpiry .AuthExpire}}" placeholder="never">
+                </div>
+
+                <div class="col-sm-12">
+                  <label for="notes-{{.Id}}">Notes</label>
+                  <input type="text" size="5" id="notes-{{.Id}}" name="notes" value="{{.Notes}}" placeholder="optional notes">
+                </div>
+              </div>
+
+              <div class="row">
+                {{ $.CsrfTemplate }}
+                <div class="col-sm-12 col-md-12">
+                  <button class="primary">Save</button>
+                </div>
+              </div>
+            </form>
+
+            <h4>Keys</h4>
+            {{$id := .Id}}
+            {{range .Keys}}
+              <form class="inline" action="{{$.Config.Prefix}}/removekey" method="POST">
+                {{ $.CsrfTemplate }}
+                <input type="hidden" name="id" value="{{$id}}">
+                <input type="hidden" name="name" value="{{.Name}}">
+                <span>{{.Name}}{{if ne .Expire -1}} until {{formatTime .Expire}}{{end}}</span>
+                <button class="secondary">Remove key</button>
+              </form>
+            {{end}}
+            <form class="addForm" action="{{$.Config.Prefix}}/addkey" method="POST" novalidate>
+              <input type="hidden" name="id" value="{{.Id}}">
+              <div class="row">
+                <div class="col-sm-12 col-md-4">
+                  <label for="keyName-{{.Id}}">Key Name</label>
+                  <input type="text" size="5" id="keyName-{{.Id}}" name="name" placeholder="e.g. backup encoder">
+                </div>
+
+                <div class="col-sm-12 col-md-4">
+                  <label for="key-{{.Id}}">Key</label>
+                  <input type="text" size="3" id="key-{{.Id}}" name="key"><button class="secondary generateKey inputAddon">Generate key</button>
+                </div>
+
+                <div class="col-sm-12 col-md-4">
+                  <label for="keyExpire-{{.Id}}">Valid Until</label>
+                  <input type="text" size="5" id="keyExpire-{{.Id}}" name="expire" placeholder="never">
+                </div>
+              </div>
+              <div class="row">
+                {{ $.CsrfTemplate }}
+                <div class="col-sm-12 col-md-12">
+                  <button class="secondary">Add key</button>
+                </div>
+              </div>
+            </form>
+
+            <form class="addForm" action="{{$.Config.Prefix}}/rotate" method="POST" novalidate>
+              <input type="hidden" name="id" value="{{.Id}}">
+              <div class="row">
+                <div class="col-sm-12 col-md-6">
+                  <label for="grace-{{.Id}}">Grace Period
+                    <span class="tooltip" aria-label="The previous auth key stays valid for this ISO8601 Duration (e.g. PT1H), empty for none">
+                      <span class="icon-help"></span>
+                    </span>
+                  </label>
+                  <input type="text" size="5" id="grace-{{.Id}}" name="grace" value="PT1H">
+                </div>
+              </div>
+              <div class="row">
+                {{ $.CsrfTemplate }}
+                <div class="col-sm-12 col-md-12">
+                  <button class="secondary">Rotate key</button>
+                </div>
+              </div>
+            </form>
           </td>
         </tr>
+        {{end}}
       {{end}}
       </tbody>
     </table>
 
+    {{with $.Perms.Editable $.Config.Applications}}
     <h2>Add Stream</h2>
     <form class="addForm" action="{{$.Config.Prefix}}/add" method="POST" novalidate>
       <div class="row">
         <div class="col-sm-12 col-md-6">
           <label for="application">Application</label>
           <select type="text" id="application" name="application">
-            {{range $.Config.Applications}}
+            {{range .}}
               <option value="{{.}}">{{.}}</option>
             {{end}}
           </select>
         </div>
 
+        {{if $.Config.VHosts}}
+        <div class="col-sm-12 col-md-6">
+          <label for="vhost">VHost</label>
+          <select type="text" id="vhost" name="vhost">
+            <option value="">all</option>
+            {{range $.Config.VHosts}}
+              <option value="{{.}}">{{.}}</option>
+            {{end}}
+          </select>
+        </div>
+        {{end}}
+
         <div class="col-sm-12 col-md-6">
           <label for="stream">Stream</label>
           <input type="text" size="5" id="stream" name="name" placeholder="enter name">
@@ -110,6 +302,11 @@ var templates = template.Must(template.New("form.html").Parse(
           <input type="text" size="3" id="authKey" name="auth_key" placeholder="no auth"><button class="secondary generateKey inputAddon">Generate key</button>
         </div>
 
+        <div class="col-sm-12 col-md-6">
+          <label for="playKey">Play Key</label>
+          <input type="text" size="3" id="playKey" name="play_key" placeholder="public"><button class="secondary generateKey inputAddon">Generate key</button>
+        </div>
+
         <div class="col-sm-12 col-md-6">
           <label for="authExpire">Auth Expire
             <span class="tooltip" aria-label="ISO8601 Duration (e.g. P2DT10H) or empty for no expiry">
@@ -126,13 +323,130 @@ var templates = template.Must(template.New("form.html").Parse(
       </div>
 
       <div class="row">
-        {{ .CsrfTemplate }}
+        {{ $.CsrfTemplate }}
         <div class="col-sm-12 col-md-12">
           <button class="primary">Submit</button>
         </div>
       </div>
     </form>
+    {{end}}
+
+    {{$tokenApps := $.Perms.Editable $.Config.Applications}}
+    {{if and .Tokens $tokenApps}}
+    <h2>Sign Token</h2>
+    {{if .Token}}
+      <div class="row">
+        <div class="card fluid">
+          <div class="section">
+            <h3>Token for {{.TokenStream}}</h3>
+            <p><input class="authKey" size="5" value="{{.Token}}" readonly/><button class="secondary copyToClipboard inputAddon">Copy</button></p>
+          </div>
+        </div>
+      </div>
+    {{end}}
+    <form class="addForm" action="{{$.Config.Prefix}}/token" method="POST" novalidate>
+      <div class="row">
+        <div class="col-sm-12 col-md-6">
+          <label for="tokenApplication">Application</label>
+          <select type="text" id="tokenApplication" name="application">
+            {{range $tokenApps}}
+              <option value="{{.}}">{{.}}</option>
+            {{end}}
+          </select>
+        </div>
+
+        <div class="col-sm-12 col-md-6">
+          <label for="tokenStream">Stream</label>
+          <input type="text" size="5" id="tokenStream" name="name" placeholder="enter name">
+        </div>
+
+        <div class="col-sm-12 col-md-6">
+          <label for="tokenScope">Scope</label>
+          <select type="text" id="tokenScope" name="scope">
+            <option value="publish">publish</option>
+            <option value="play">play</option>
+          </select>
+        </div>
+
+        <div class="col-sm-12 col-md-6">
+          <label for="tokenExpire">Token Expire
+            <span class="tooltip" aria-label="ISO8601 Duration (e.g. P2DT10H) or empty for no expiry">
+              <span class="icon-help"></span>
+            </span>
+          </label>
+          <input type="text" size="5" id="tokenExpire" name="auth_expire" placeholder="never">
+        </div>
+      </div>
+
+      <div class="row">
+        {{ .CsrfTemplate }}
+        <div class="col-sm-12 col-md-12">
+          <button class="primary">Sign</button>
+        </div>
+      </div>
+    </form>
+    {{end}}
   </div>
 <script src="{{.Config.Prefix}}/public/main.js"></script>
 </body>
 </html>`))
+
+var _ = template.Must(templates.New("login.html").Parse(
+	`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="UTF-8">
+  <title>RTMP Admin</title>
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <link rel="stylesheet" type="text/css" href="{{.Config.Prefix}}/public/mini-dark.css">
+  <link rel="stylesheet" type="text/css" href="{{.Config.Prefix}}/public/main.css">
+</head>
+<body>
+  <div class="container">
+    <h1><a href="{{$.Config.Prefix}}">rtmp-auth</a></h1>
+    <h2>Login</h2>
+
+    <div class="row">
+      {{range .Errors}}
+        <div class="card error">
+          <div class="section">
+            <h3>Error</h3>
+            <p>{{.Error}}</p>
+          </div>
+        </div>
+      {{end}}
+    </div>
+
+    {{if .OIDC}}
+      <div class="row">
+        <div class="col-sm-12 col-md-12">
+          <a class="button primary" href="{{$.Config.Prefix}}/oidc/login">Login with SSO</a>
+        </div>
+      </div>
+    {{end}}
+
+    {{if .Local}}
+    <form class="addForm" action="{{$.Config.Prefix}}/login" method="POST">
+      <div class="row">
+        <div class="col-sm-12 col-md-6">
+          <label for="user">User</label>
+          <input type="text" size="5" id="user" name="user" autocomplete="username" autofocus>
+        </div>
+
+        <div class="col-sm-12 col-md-6">
+          <label for="password">Password</label>
+          <input type="password" size="5" id="password" name="password" autocomplete="current-password">
+        </div>
+      </div>
+
+      <div class="row">
+        {{ .CsrfTemplate }}
+        <div class="col-sm-12 col-md-12">
+          <button class="primary">Login</button>
+        </div>
+      </div>
+    </form>
+    {{end}}
+  </div>
+</body>
+</html>`))
@@ -0,0 +1,118 @@
+package ingest
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Action is the normalized action of an ingest server callback
+type Action int
+
+const (
+	// ActionNone is answered with success without touching the store,
+	// e.g. for players leaving a stream
+	ActionNone Action = iota
+	ActionPublish
+	ActionUnpublish
+	// ActionUpdate is sent periodically while a stream is published
+	ActionUpdate
+	ActionPlay
+)
+
+// ErrUnauthorized is returned by Decode for requests which should be denied without looking at the stream
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Event is a callback of an ingest server, normalized by its adapter
+type Event struct {
+	Action Action
+	App    string
+	Name   string
+	Key    string
+	// VHost is the virtual host of servers like SRS, empty for the default vhost
+	VHost string
+	// ClientIP is the address of the publisher or player
+	ClientIP string
+	// Server identifies the ingest server, ServerAddr is the address it called from
+	Server     string
+	ServerAddr string
+	TcURL      string
+	// Params holds the query parameters of the request url
+	Params url.Values
+	// StreamID is the SRT streamid, if passed by the server
+	StreamID string
+	// CanRename is set by servers which can rename a publish in their response
+	CanRename bool
+	// NoUnpublish is set by servers which never report the end of a publish,
+	// their streams are not marked active
+	NoUnpublish bool
+}
+
+// Result is the outcome of handling an event
+type Result struct {
+	// Err is the reason the request was denied, nil if it was allowed
+	Err error
+	// Status is the HTTP status code matching Err
+	Status int
+	// Lifetime is the remaining auth time of a publish, 0 for unlimited
+	Lifetime time.Duration
+	// Rename is the public name an allowed publish is renamed to, empty to keep the name
+	Rename string
+}
+
+// Adapter translates between the callbacks of an ingest server and events
+type Adapter interface {
+	// Decode parses a callback request into an event
+	Decode(r *http.Request) (*Event, error)
+	// Encode writes the response the ingest server expects for the result of an event
+	Encode(w http.ResponseWriter, event *Event, res Result)
+}
+
+// Registry holds the adapters by name
+type Registry struct {
+	adapters map[string]Adapter
+}
+
+func NewRegistry() *Registry {
+	return &Registry{adapters: make(map[string]Adapter)}
+}
+
+// Register adds an adapter, replacing any adapter with the same name
+func (reg *Registry) Register(name string, adapter Adapter) {
+	reg.adapters[name] = adapter
+}
+
+func (reg *Registry) Get(name string) (Adapter, bool) {
+	adapter, ok := reg.adapters[name]
+	return adapter, ok
+}
+
+// Names returns the sorted names of all adapters
+func (reg *Registry) Names() []string {
+	names := make([]string, 0, len(reg.adapters))
+	for name := range reg.adapters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Detect guesses the adapter of a request, SRS sends JSON while nginx-rtmp and srtrelay send form data
+func Detect(r *http.Request) string {
+	if r.Header.Get("Content-Type") == "application/json" {
+		return "srs"
+	}
+	return "nginx"
+}
+
+// RemoteHost returns the host of the ingest server calling the API
+func RemoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
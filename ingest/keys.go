@@ -0,0 +1,105 @@
+package ingest
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// KeySource describes where the key of a callback is read from
+type KeySource struct {
+	// Kind is one of query, tcurl, suffix, streamid or default
+	Kind string
+	// Arg is the parameter name, name separator or streamid field
+	Arg string
+}
+
+// ParseKeySource parses a key source in the form kind:arg
+//   - query:<param> reads a query parameter of the stream url
+//   - tcurl:<param> reads a query parameter of the RTMP connect url (tcUrl)
+//   - suffix:<separator> splits the key from the end of the stream name, e.g. name.key
+//   - streamid:<field> reads a field of a SRT access control streamid (#!::r=app/name,s=key)
+//   - default uses the key found by the adapter, e.g. ?auth= or the MediaMTX password
+func ParseKeySource(spec string) (KeySource, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	source := KeySource{Kind: parts[0]}
+	if len(parts) == 2 {
+		source.Arg = parts[1]
+	}
+	switch source.Kind {
+	case "query", "tcurl", "suffix", "streamid":
+		if source.Arg == "" {
+			return source, fmt.Errorf("key source '%v' needs an argument", spec)
+		}
+	case "default":
+	default:
+		return source, fmt.Errorf("unknown key source '%v'", spec)
+	}
+	return source, nil
+}
+
+func ParseKeySources(specs []string) ([]KeySource, error) {
+	sources := make([]KeySource, 0, len(specs))
+	for _, spec := range specs {
+		source, err := ParseKeySource(spec)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// parseStreamID returns the fields of a SRT access control streamid
+func parseStreamID(streamid string) map[string]string {
+	fields := make(map[string]string)
+	if !strings.HasPrefix(streamid, "#!::") {
+		return fields
+	}
+	for _, field := range strings.Split(streamid[4:], ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	return fields
+}
+
+// extract returns the key of a source, suffixes are split off the stream name
+func (source KeySource) extract(event *Event, fallback string) string {
+	switch source.Kind {
+	case "query":
+		return event.Params.Get(source.Arg)
+	case "tcurl":
+		if u, err := url.Parse(event.TcURL); err == nil {
+			return u.Query().Get(source.Arg)
+		}
+	case "suffix":
+		if i := strings.LastIndex(event.Name, source.Arg); i > 0 {
+			key := event.Name[i+len(source.Arg):]
+			event.Name = event.Name[:i]
+			return key
+		}
+	case "streamid":
+		streamid := event.StreamID
+		if streamid == "" {
+			streamid = event.Params.Get("streamid")
+		}
+		return parseStreamID(streamid)[source.Arg]
+	case "default":
+		return fallback
+	}
+	return ""
+}
+
+// ExtractKey sets the key of an event from the first source providing a key
+func ExtractKey(event *Event, sources []KeySource) {
+	fallback := event.Key
+	event.Key = ""
+	for _, source := range sources {
+		if key := source.extract(event, fallback); key != "" {
+			event.Key = key
+			return
+		}
+	}
+}
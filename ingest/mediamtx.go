@@ -0,0 +1,80 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MediaMTXAdapter handles the external HTTP authentication of MediaMTX (authHTTPAddress)
+type MediaMTXAdapter struct{}
+
+// MediaMTXAuth is the body of a MediaMTX authentication request
+type MediaMTXAuth struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	IP       string `json:"ip"`
+	Action   string `json:"action"`
+	Path     string `json:"path"`
+	Protocol string `json:"protocol"`
+	ID       string `json:"id"`
+	Query    string `json:"query"`
+}
+
+// splitPath maps a MediaMTX path to app/name, single element paths have an empty app
+func splitPath(path string) (app string, name string) {
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+func (MediaMTXAdapter) Decode(r *http.Request) (*Event, error) {
+	var req MediaMTXAuth
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	var action Action
+	switch req.Action {
+	case "publish":
+		action = ActionPublish
+	case "read", "playback":
+		action = ActionPlay
+	default:
+		// api, metrics and pprof access is not managed by rtmp-auth
+		return nil, fmt.Errorf("%w: action %v", ErrUnauthorized, req.Action)
+	}
+
+	params, err := url.ParseQuery(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	app, name := splitPath(req.Path)
+	event := &Event{
+		Action:     action,
+		App:        app,
+		Name:       name,
+		Key:        params.Get("auth"),
+		ClientIP:   req.IP,
+		Server:     RemoteHost(r),
+		ServerAddr: RemoteHost(r),
+		Params:     params,
+		// MediaMTX doesn't report the end of a publish
+		NoUnpublish: true,
+	}
+	// prefer ?auth= like the other servers, fall back to the password
+	if event.Key == "" {
+		event.Key = req.Password
+	}
+	return event, nil
+}
+
+func (MediaMTXAdapter) Encode(w http.ResponseWriter, event *Event, res Result) {
+	if res.Err != nil {
+		http.Error(w, fmt.Sprintf("%d %s", res.Status, res.Err), res.Status)
+	}
+}
@@ -0,0 +1,104 @@
+package ingest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMediaMTXDecode(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		action       Action
+		app          string
+		stream       string
+		key          string
+		unauthorized bool
+	}{
+		{
+			name:   "publish with query key",
+			body:   `{"user":"","password":"pw","ip":"198.51.100.7","action":"publish","path":"stream/foo","protocol":"rtmp","query":"auth=secret"}`,
+			action: ActionPublish,
+			app:    "stream",
+			stream: "foo",
+			key:    "secret",
+		},
+		{
+			name:   "publish with password",
+			body:   `{"password":"pw","action":"publish","path":"stream/foo","protocol":"srt"}`,
+			action: ActionPublish,
+			app:    "stream",
+			stream: "foo",
+			key:    "pw",
+		},
+		{
+			name:   "read without app",
+			body:   `{"action":"read","path":"foo","protocol":"hls"}`,
+			action: ActionPlay,
+			stream: "foo",
+		},
+		{
+			name:   "playback",
+			body:   `{"action":"playback","path":"/stream/foo/","query":"auth=secret"}`,
+			action: ActionPlay,
+			app:    "stream",
+			stream: "foo",
+			key:    "secret",
+		},
+		{name: "api", body: `{"action":"api"}`, unauthorized: true},
+		{name: "metrics", body: `{"action":"metrics"}`, unauthorized: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/mediamtx", strings.NewReader(test.body))
+			event, err := MediaMTXAdapter{}.Decode(r)
+			if test.unauthorized {
+				if !errors.Is(err, ErrUnauthorized) {
+					t.Fatalf("err = %v, want %v", err, ErrUnauthorized)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Action != test.action {
+				t.Errorf("action = %v, want %v", event.Action, test.action)
+			}
+			if event.App != test.app || event.Name != test.stream {
+				t.Errorf("got %q/%q, want %q/%q", event.App, event.Name, test.app, test.stream)
+			}
+			if event.Key != test.key {
+				t.Errorf("key = %q, want %q", event.Key, test.key)
+			}
+			if event.TcURL != "" {
+				t.Errorf("tcurl = %q, want empty", event.TcURL)
+			}
+			if !event.NoUnpublish {
+				t.Error("mediamtx events must be NoUnpublish")
+			}
+		})
+	}
+}
+
+func TestMediaMTXEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		res    Result
+		status int
+	}{
+		{"allowed", Result{}, http.StatusOK},
+		{"denied", Result{Err: errors.New("wrong auth key"), Status: http.StatusForbidden}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			MediaMTXAdapter{}.Encode(w, &Event{Action: ActionPublish}, test.res)
+			if w.Code != test.status {
+				t.Errorf("status = %v, want %v", w.Code, test.status)
+			}
+		})
+	}
+}
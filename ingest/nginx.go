@@ -0,0 +1,50 @@
+package ingest
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// NginxAdapter handles the on_publish, on_publish_done, on_play and on_update callbacks of nginx-rtmp
+type NginxAdapter struct{}
+
+var nginxActions = map[string]Action{
+	"publish":        ActionPublish,
+	"publish_done":   ActionUnpublish,
+	"unpublish":      ActionUnpublish,
+	"update_publish": ActionUpdate,
+	"play":           ActionPlay,
+}
+
+func (NginxAdapter) Decode(r *http.Request) (*Event, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	// other calls like play_done are acknowledged with ActionNone
+	return &Event{
+		Action:     nginxActions[r.PostForm.Get("call")],
+		App:        r.PostForm.Get("app"),
+		Name:       r.PostForm.Get("name"),
+		Key:        r.PostForm.Get("auth"),
+		ClientIP:   r.PostForm.Get("addr"),
+		Server:     RemoteHost(r),
+		ServerAddr: RemoteHost(r),
+		TcURL:      r.PostForm.Get("tcurl"),
+		Params:     r.PostForm,
+		CanRename:  true,
+	}, nil
+}
+
+// Encode denies with the error status, nginx-rtmp accepts any 2xx
+// and renames the stream to the Location of a 3xx
+func (NginxAdapter) Encode(w http.ResponseWriter, event *Event, res Result) {
+	if res.Err != nil {
+		http.Error(w, fmt.Sprintf("%d %s", res.Status, res.Err), res.Status)
+		return
+	}
+	if res.Rename != "" {
+		w.Header().Set("Location", res.Rename)
+		w.WriteHeader(http.StatusFound)
+	}
+}
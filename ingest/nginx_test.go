@@ -0,0 +1,88 @@
+package ingest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func formRequest(path string, form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestNginxDecode(t *testing.T) {
+	tests := []struct {
+		call   string
+		action Action
+	}{
+		{"publish", ActionPublish},
+		{"publish_done", ActionUnpublish},
+		{"unpublish", ActionUnpublish},
+		{"update_publish", ActionUpdate},
+		{"play", ActionPlay},
+		{"play_done", ActionNone},
+	}
+	for _, test := range tests {
+		t.Run(test.call, func(t *testing.T) {
+			r := formRequest("/nginx", url.Values{
+				"call":  {test.call},
+				"app":   {"stream"},
+				"name":  {"foo"},
+				"auth":  {"secret"},
+				"addr":  {"198.51.100.7"},
+				"tcurl": {"rtmp://example.org/stream"},
+			})
+			event, err := NginxAdapter{}.Decode(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Action != test.action {
+				t.Errorf("action = %v, want %v", event.Action, test.action)
+			}
+			if event.App != "stream" || event.Name != "foo" || event.Key != "secret" {
+				t.Errorf("got %v/%v key %v, want stream/foo key secret", event.App, event.Name, event.Key)
+			}
+			if event.ClientIP != "198.51.100.7" || event.TcURL != "rtmp://example.org/stream" {
+				t.Errorf("client %v tcurl %v", event.ClientIP, event.TcURL)
+			}
+			// httptest requests come from 192.0.2.1:1234
+			if event.Server != "192.0.2.1" || event.ServerAddr != "192.0.2.1" {
+				t.Errorf("server = %v, addr %v", event.Server, event.ServerAddr)
+			}
+			if !event.CanRename || event.NoUnpublish {
+				t.Errorf("CanRename = %v, NoUnpublish = %v", event.CanRename, event.NoUnpublish)
+			}
+		})
+	}
+}
+
+func TestNginxEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		res      Result
+		status   int
+		location string
+	}{
+		{"allowed", Result{}, http.StatusOK, ""},
+		{"renamed", Result{Rename: "public"}, http.StatusFound, "public"},
+		{"denied", Result{Err: errors.New("wrong auth key"), Status: http.StatusForbidden}, http.StatusForbidden, ""},
+		{"denied rename", Result{Err: errors.New("blocked"), Status: http.StatusForbidden, Rename: "public"}, http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			NginxAdapter{}.Encode(w, &Event{Action: ActionPublish}, test.res)
+			if w.Code != test.status {
+				t.Errorf("status = %v, want %v", w.Code, test.status)
+			}
+			if location := w.Header().Get("Location"); location != test.location {
+				t.Errorf("location = %q, want %q", location, test.location)
+			}
+		})
+	}
+}
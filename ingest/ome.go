@@ -0,0 +1,197 @@
+package ingest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OMEConfig configures the OvenMediaEngine admission webhook
+type OMEConfig struct {
+	// Secret key of the AdmissionWebhooks config, signatures are not checked if empty
+	Secret string `toml:"secret" json:"-"`
+}
+
+// OMEAdapter handles the admission webhooks of OvenMediaEngine
+type OMEAdapter struct {
+	config OMEConfig
+}
+
+func NewOMEAdapter(config OMEConfig) *OMEAdapter {
+	return &OMEAdapter{config: config}
+}
+
+// OMEAdmission is the request body of an OvenMediaEngine admission webhook
+type OMEAdmission struct {
+	Client struct {
+		Address   string `json:"address"`
+		Port      int    `json:"port"`
+		RealIP    string `json:"real_ip"`
+		UserAgent string `json:"user_agent"`
+	} `json:"client"`
+	Request struct {
+		// incoming for publishers, outgoing for players
+		Direction string `json:"direction"`
+		Protocol  string `json:"protocol"`
+		// opening or closing
+		Status string `json:"status"`
+		URL    string `json:"url"`
+		Time   string `json:"time"`
+	} `json:"request"`
+}
+
+// OMEResponse is the reply to an opening admission request, closing requests are answered with an empty object
+type OMEResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+	// Lifetime of the session in milliseconds, 0 for infinite
+	Lifetime int64 `json:"lifetime"`
+	// NewURL redirects the publish to another stream name
+	NewURL string `json:"new_url,omitempty"`
+}
+
+const omeSignatureHeader = "X-OME-Signature"
+
+// verifyOMESignature checks the unpadded base64url HMAC-SHA1 of the body
+func verifyOMESignature(secret string, body []byte, signature string) error {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(strings.TrimRight(signature, "=")), []byte(expected)) {
+		return fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+	}
+	return nil
+}
+
+// parseOMEURL extracts app, stream, query and SRT streamid from an admission url,
+// e.g. rtmp://host/app/stream?auth=key or srt://host?streamid=srt://host/app/stream?auth=key
+func parseOMEURL(str string) (app string, name string, params url.Values, streamid string, err error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return
+	}
+	if streamid = u.Query().Get("streamid"); streamid != "" {
+		if u, err = url.Parse(streamid); err != nil {
+			return
+		}
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 {
+		err = fmt.Errorf("no app/stream in url '%v'", str)
+		return
+	}
+	// further path elements are playlists or files
+	app, name = parts[0], parts[1]
+	params = u.Query()
+	return
+}
+
+// renameOMEURL replaces the stream name in an admission url
+func renameOMEURL(str string, name string) (string, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	if streamid := query.Get("streamid"); streamid != "" {
+		renamed, err := renameOMEURL(streamid, name)
+		if err != nil {
+			return "", err
+		}
+		query.Set("streamid", renamed)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if len(parts) < 2 {
+		return "", fmt.Errorf("no app/stream in url '%v'", str)
+	}
+	parts[1] = name
+	u.Path = "/" + strings.Join(parts, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+func (adapter *OMEAdapter) Decode(r *http.Request) (*Event, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if adapter.config.Secret != "" {
+		if err := verifyOMESignature(adapter.config.Secret, body, r.Header.Get(omeSignatureHeader)); err != nil {
+			return nil, err
+		}
+	}
+
+	var admission OMEAdmission
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&admission); err != nil {
+		return nil, err
+	}
+	app, name, params, streamid, err := parseOMEURL(admission.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &Event{
+		App:        app,
+		Name:       name,
+		Key:        params.Get("auth"),
+		ClientIP:   admission.Client.RealIP,
+		Server:     RemoteHost(r),
+		ServerAddr: RemoteHost(r),
+		TcURL:      admission.Request.URL,
+		Params:     params,
+		StreamID:   streamid,
+		CanRename:  true,
+	}
+	if event.ClientIP == "" {
+		event.ClientIP = admission.Client.Address
+	}
+
+	incoming := admission.Request.Direction == "incoming"
+	opening := admission.Request.Status == "opening"
+	switch {
+	case incoming && opening:
+		event.Action = ActionPublish
+	case incoming:
+		event.Action = ActionUnpublish
+	case opening:
+		event.Action = ActionPlay
+	}
+	return event, nil
+}
+
+// Encode answers with allowed and the remaining auth time as lifetime,
+// closing requests get an empty object
+func (adapter *OMEAdapter) Encode(w http.ResponseWriter, event *Event, res Result) {
+	var value interface{} = struct{}{}
+	if event.Action == ActionPublish || event.Action == ActionPlay {
+		response := OMEResponse{Allowed: res.Err == nil, Lifetime: res.Lifetime.Milliseconds()}
+		if res.Err != nil {
+			response.Reason = res.Err.Error()
+		}
+		if res.Err == nil && res.Rename != "" {
+			newURL, err := renameOMEURL(event.TcURL, res.Rename)
+			if err != nil {
+				log.Println("ome: rename", err)
+			}
+			response.NewURL = newURL
+		}
+		value = response
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("ome: encode response", err)
+	}
+}
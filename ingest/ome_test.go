@@ -0,0 +1,175 @@
+package ingest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func omeBody(direction string, status string, url string) string {
+	return `{"client":{"address":"198.51.100.7","port":4000},` +
+		`"request":{"direction":"` + direction + `","protocol":"rtmp","status":"` + status + `","url":"` + url + `"}}`
+}
+
+func omeSign(secret string, body string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestOMEDecode(t *testing.T) {
+	const secret = "hook-secret"
+	tests := []struct {
+		name      string
+		body      string
+		signature string
+		action    Action
+		key       string
+		streamid  string
+		invalid   bool
+	}{
+		{
+			name:   "publish",
+			body:   omeBody("incoming", "opening", "rtmp://example.org/stream/foo?auth=secret"),
+			action: ActionPublish,
+			key:    "secret",
+		},
+		{
+			name:   "unpublish",
+			body:   omeBody("incoming", "closing", "rtmp://example.org/stream/foo"),
+			action: ActionUnpublish,
+		},
+		{
+			name:   "play with playlist",
+			body:   omeBody("outgoing", "opening", "https://example.org/stream/foo/playlist.m3u8?auth=secret"),
+			action: ActionPlay,
+			key:    "secret",
+		},
+		{
+			name:   "stop playing",
+			body:   omeBody("outgoing", "closing", "https://example.org/stream/foo/playlist.m3u8"),
+			action: ActionNone,
+		},
+		{
+			name:     "srt streamid",
+			body:     omeBody("incoming", "opening", "srt://example.org:9999?streamid=srt%3A%2F%2Fexample.org%3A9999%2Fstream%2Ffoo%3Fauth%3Dsecret"),
+			action:   ActionPublish,
+			key:      "secret",
+			streamid: "srt://example.org:9999/stream/foo?auth=secret",
+		},
+		{name: "no stream", body: omeBody("incoming", "opening", "rtmp://example.org/stream"), invalid: true},
+		{name: "wrong signature", body: omeBody("incoming", "opening", "rtmp://example.org/stream/foo"), signature: "invalid", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/ome", strings.NewReader(test.body))
+			signature := test.signature
+			if signature == "" {
+				signature = omeSign(secret, test.body)
+			}
+			r.Header.Set(omeSignatureHeader, signature)
+
+			event, err := NewOMEAdapter(OMEConfig{Secret: secret}).Decode(r)
+			if test.invalid {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Action != test.action {
+				t.Errorf("action = %v, want %v", event.Action, test.action)
+			}
+			if event.App != "stream" || event.Name != "foo" {
+				t.Errorf("got %v/%v, want stream/foo", event.App, event.Name)
+			}
+			if event.Key != test.key {
+				t.Errorf("key = %q, want %q", event.Key, test.key)
+			}
+			if event.StreamID != test.streamid {
+				t.Errorf("streamid = %q, want %q", event.StreamID, test.streamid)
+			}
+			if event.ClientIP != "198.51.100.7" {
+				t.Errorf("client = %v, want 198.51.100.7", event.ClientIP)
+			}
+		})
+	}
+}
+
+func TestOMEDecodeUnsigned(t *testing.T) {
+	body := omeBody("incoming", "opening", "rtmp://example.org/stream/foo")
+	r := httptest.NewRequest("POST", "/ome", strings.NewReader(body))
+	if _, err := NewOMEAdapter(OMEConfig{}).Decode(r); err != nil {
+		t.Errorf("signatures must not be checked without secret: %v", err)
+	}
+}
+
+func TestOMEEncode(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		res   Result
+		want  string
+	}{
+		{
+			name:  "allowed",
+			event: Event{Action: ActionPublish, TcURL: "rtmp://example.org/stream/foo"},
+			res:   Result{Lifetime: 90 * time.Second},
+			want:  `{"allowed":true,"lifetime":90000}`,
+		},
+		{
+			name:  "denied",
+			event: Event{Action: ActionPlay, TcURL: "rtmp://example.org/stream/foo"},
+			res:   Result{Err: errors.New("wrong auth key"), Status: 403},
+			want:  `{"allowed":false,"reason":"wrong auth key","lifetime":0}`,
+		},
+		{
+			name:  "renamed",
+			event: Event{Action: ActionPublish, TcURL: "rtmp://example.org/stream/foo?auth=secret"},
+			res:   Result{Rename: "public"},
+			want:  `{"allowed":true,"lifetime":0,"new_url":"rtmp://example.org/stream/public?auth=secret"}`,
+		},
+		{
+			name:  "renamed srt",
+			event: Event{Action: ActionPublish, TcURL: "srt://example.org:9999?streamid=srt%3A%2F%2Fexample.org%3A9999%2Fstream%2Ffoo"},
+			res:   Result{Rename: "public"},
+			want:  `{"allowed":true,"lifetime":0,"new_url":"srt://example.org:9999?streamid=srt%3A%2F%2Fexample.org%3A9999%2Fstream%2Fpublic"}`,
+		},
+		{
+			name:  "closing",
+			event: Event{Action: ActionUnpublish},
+			res:   Result{},
+			want:  `{}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			NewOMEAdapter(OMEConfig{}).Encode(w, &test.event, test.res)
+			if w.Code != 200 {
+				t.Errorf("status = %v, want 200", w.Code)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("content type = %v", contentType)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			json.Unmarshal([]byte(test.want), &want)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("response = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SRSAdapter handles the http_hooks of SRS
+type SRSAdapter struct{}
+
+// SRSCallback is the body of SRS http_hooks
+type SRSCallback struct {
+	Action string `json:"action"`
+	IP     string `json:"ip"`
+	VHost  string `json:"vhost"`
+	App    string `json:"app"`
+	Url    string `json:"tcUrl"`
+	Stream string `json:"stream"`
+	Param  string `json:"param"`
+	// Server id is sent by SRS 4 and later
+	ServerId string `json:"server_id"`
+}
+
+// srsDefaultVhost is used by SRS for publishes without vhost, it is stored as empty vhost
+const srsDefaultVhost = "__defaultVhost__"
+
+var srsActions = map[string]Action{
+	"on_publish":   ActionPublish,
+	"on_unpublish": ActionUnpublish,
+	"on_play":      ActionPlay,
+	"on_stop":      ActionNone,
+}
+
+func (SRSAdapter) Decode(r *http.Request) (*Event, error) {
+	var callback SRSCallback
+	if err := json.NewDecoder(r.Body).Decode(&callback); err != nil {
+		return nil, err
+	}
+
+	action, ok := srsActions[callback.Action]
+	if !ok {
+		return nil, fmt.Errorf("invalid action %s", callback.Action)
+	}
+	params, err := url.ParseQuery(strings.TrimPrefix(callback.Param, "?"))
+	if err != nil {
+		return nil, err
+	}
+
+	event := &Event{
+		Action:     action,
+		App:        callback.App,
+		Name:       callback.Stream,
+		Key:        params.Get("auth"),
+		VHost:      callback.VHost,
+		ClientIP:   callback.IP,
+		Server:     callback.ServerId,
+		ServerAddr: RemoteHost(r),
+		TcURL:      callback.Url,
+		Params:     params,
+	}
+	if event.Server == "" {
+		event.Server = RemoteHost(r)
+	}
+	if event.VHost == srsDefaultVhost {
+		event.VHost = ""
+	}
+	return event, nil
+}
+
+// Encode denies with the error status, SRS needs a zero response on success
+func (SRSAdapter) Encode(w http.ResponseWriter, event *Event, res Result) {
+	if res.Err != nil {
+		http.Error(w, fmt.Sprintf("%d %s", res.Status, res.Err), res.Status)
+		return
+	}
+	w.Write([]byte("0"))
+}
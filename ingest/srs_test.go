@@ -0,0 +1,106 @@
+package ingest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSRSDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		action  Action
+		vhost   string
+		key     string
+		server  string
+		invalid bool
+	}{
+		{
+			name:   "publish",
+			body:   `{"action":"on_publish","ip":"198.51.100.7","vhost":"__defaultVhost__","app":"stream","tcUrl":"rtmp://example.org/stream","stream":"foo","param":"?auth=secret","server_id":"vid-1"}`,
+			action: ActionPublish,
+			key:    "secret",
+			server: "vid-1",
+		},
+		{
+			name:   "unpublish on vhost",
+			body:   `{"action":"on_unpublish","vhost":"a.example","app":"stream","stream":"foo","param":""}`,
+			action: ActionUnpublish,
+			vhost:  "a.example",
+			server: "192.0.2.1",
+		},
+		{
+			name:   "play",
+			body:   `{"action":"on_play","vhost":"__defaultVhost__","app":"stream","stream":"foo","param":"auth=secret&x=y"}`,
+			action: ActionPlay,
+			key:    "secret",
+			server: "192.0.2.1",
+		},
+		{
+			name:   "stop",
+			body:   `{"action":"on_stop","app":"stream","stream":"foo"}`,
+			action: ActionNone,
+			server: "192.0.2.1",
+		},
+		{name: "unknown action", body: `{"action":"on_dvr"}`, invalid: true},
+		{name: "invalid json", body: `action=on_publish`, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/srs", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/json")
+			event, err := SRSAdapter{}.Decode(r)
+			if test.invalid {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Action != test.action {
+				t.Errorf("action = %v, want %v", event.Action, test.action)
+			}
+			if event.App != "stream" || event.Name != "foo" {
+				t.Errorf("got %v/%v, want stream/foo", event.App, event.Name)
+			}
+			if event.VHost != test.vhost {
+				t.Errorf("vhost = %q, want %q", event.VHost, test.vhost)
+			}
+			if event.Key != test.key {
+				t.Errorf("key = %q, want %q", event.Key, test.key)
+			}
+			if event.Server != test.server || event.ServerAddr != "192.0.2.1" {
+				t.Errorf("server = %v, addr %v, want %v", event.Server, event.ServerAddr, test.server)
+			}
+		})
+	}
+}
+
+func TestSRSEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		res    Result
+		status int
+		body   string
+	}{
+		{"allowed", Result{}, http.StatusOK, "0"},
+		{"denied", Result{Err: errors.New("wrong auth key"), Status: http.StatusForbidden}, http.StatusForbidden, "403 wrong auth key\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			SRSAdapter{}.Encode(w, &Event{Action: ActionPublish}, test.res)
+			if w.Code != test.status {
+				t.Errorf("status = %v, want %v", w.Code, test.status)
+			}
+			if w.Body.String() != test.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), test.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package ingest
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// SRTRelayAdapter handles the http auth of srtrelay,
+// which posts call (publish|play), app, name and the password as auth
+type SRTRelayAdapter struct{}
+
+func (SRTRelayAdapter) Decode(r *http.Request) (*Event, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	event := &Event{
+		App:        r.PostForm.Get("app"),
+		Name:       r.PostForm.Get("name"),
+		Key:        r.PostForm.Get("auth"),
+		Server:     RemoteHost(r),
+		ServerAddr: RemoteHost(r),
+		Params:     r.PostForm,
+		// srtrelay doesn't report the end of a publish
+		NoUnpublish: true,
+	}
+	switch r.PostForm.Get("call") {
+	case "publish":
+		event.Action = ActionPublish
+	case "play":
+		event.Action = ActionPlay
+	default:
+		return nil, fmt.Errorf("invalid call '%v'", r.PostForm.Get("call"))
+	}
+	return event, nil
+}
+
+func (SRTRelayAdapter) Encode(w http.ResponseWriter, event *Event, res Result) {
+	if res.Err != nil {
+		http.Error(w, fmt.Sprintf("%d %s", res.Status, res.Err), res.Status)
+	}
+}
@@ -0,0 +1,72 @@
+package ingest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSRTRelayDecode(t *testing.T) {
+	tests := []struct {
+		call    string
+		action  Action
+		invalid bool
+	}{
+		{call: "publish", action: ActionPublish},
+		{call: "play", action: ActionPlay},
+		{call: "unpublish", invalid: true},
+		{call: "", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.call, func(t *testing.T) {
+			r := formRequest("/srtrelay", url.Values{
+				"call": {test.call},
+				"app":  {"stream"},
+				"name": {"foo"},
+				"auth": {"secret"},
+			})
+			event, err := SRTRelayAdapter{}.Decode(r)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected error for call %q", test.call)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Action != test.action {
+				t.Errorf("action = %v, want %v", event.Action, test.action)
+			}
+			if event.App != "stream" || event.Name != "foo" || event.Key != "secret" {
+				t.Errorf("got %v/%v key %v, want stream/foo key secret", event.App, event.Name, event.Key)
+			}
+			if !event.NoUnpublish {
+				t.Error("srtrelay events must be NoUnpublish")
+			}
+		})
+	}
+}
+
+func TestSRTRelayEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		res    Result
+		status int
+	}{
+		{"allowed", Result{}, http.StatusOK},
+		{"denied", Result{Err: errors.New("wrong auth key"), Status: http.StatusForbidden}, http.StatusForbidden},
+		{"unknown", Result{Err: errors.New("no stream defined for app/name"), Status: http.StatusNotFound}, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			SRTRelayAdapter{}.Encode(w, &Event{Action: ActionPublish}, test.res)
+			if w.Code != test.status {
+				t.Errorf("status = %v, want %v", w.Code, test.status)
+			}
+		})
+	}
+}
@@ -16,13 +16,23 @@
   }
 
   // Generate a _really_ random key
-  document.querySelector(".generateKey").addEventListener("click", (event) => {
+  document.querySelectorAll(".generateKey").forEach(
+    (button) => button.addEventListener("click", (event) =>
+  {
     event.preventDefault();
 
     const values = encode64(crypto.getRandomValues(new Uint8Array(12)));
-    const field = document.querySelector("input[name='auth_key']");
+    const field = button.parentNode.querySelector(":scope input");
     field.value = values;
-  });
+  }))
+
+  // Toggle inline edit form
+  document.querySelectorAll(".editStream").forEach(
+    (button) => button.addEventListener("click", (event) =>
+  {
+    const row = button.closest("tr").nextElementSibling;
+    row.hidden = !row.hidden;
+  }))
 
   document.querySelectorAll(".copyToClipboard").forEach(
     (button) => button.addEventListener("click", (event) =>
@@ -1,10 +1,43 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/voc/rtmp-auth/storage"
 )
 
 type Backend interface {
 	Read() (*storage.State, error)
-	Write(state *storage.State) error
+	// Update runs fn on a copy of the current state and stores the result atomically.
+	// The state is not written if fn returns an error. fn may be called again
+	// if the state was changed concurrently, so it must not have other side effects.
+	Update(fn func(state *storage.State) error) error
+}
+
+// errUnchanged aborts an update without writing the state
+var errUnchanged = errors.New("state unchanged")
+
+// update runs fn in a backend transaction, returning errUnchanged from fn is not an error
+func (store *Store) update(fn func(state *storage.State) error) error {
+	err := store.backend.Update(fn)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	return err
+}
+
+// readSecret reads the state secret without opening the backend for writing,
+// returns nil if no secret was generated yet
+func readSecret(config StoreConfig) ([]byte, error) {
+	switch config.Backend {
+	case "file":
+		return readFileSecret(config.File)
+	case "consul":
+		return readConsulSecret(config.Consul)
+	case "bolt":
+		return readBoltSecret(config.Bolt)
+	default:
+		return nil, fmt.Errorf("Unknown backend %s", config.Backend)
+	}
 }
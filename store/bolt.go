@@ -0,0 +1,185 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/voc/rtmp-auth/storage"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+type BoltBackendConfig struct {
+	Path string
+}
+
+var (
+	// streams bucket stores each stream by its id
+	boltStreams = []byte("streams")
+	// meta bucket stores the secret
+	boltMeta   = []byte("meta")
+	boltSecret = []byte("secret")
+)
+
+// BoltBackend stores the state in an embedded bbolt database, one record per stream.
+// Writes are transactional and only touch the changed streams.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+func NewBoltBackend(config BoltBackendConfig) (Backend, error) {
+	// fail instead of blocking if another instance holds the database
+	db, err := bolt.Open(config.Path, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("open %s: database is locked by another process", config.Path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", config.Path, err)
+	}
+	bb := &BoltBackend{db: db}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltStreams, boltMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = bb.Update(func(state *storage.State) error {
+		// Clear active information for old streams
+		for _, stream := range state.Streams {
+			stream.Active = false
+			stream.Session = nil
+		}
+
+		// Generate secret
+		if len(state.Secret) == 0 {
+			state.Secret = make([]byte, 32)
+			rand.Read(state.Secret)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Println("State restored from", config.Path)
+	return bb, nil
+}
+
+// readBoltSecret reads the secret in a read-only transaction.
+// The database is locked while rtmp-auth is running, so this only works while it is stopped.
+func readBoltSecret(config BoltBackendConfig) ([]byte, error) {
+	db, err := bolt.Open(config.Path, 0o600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("open %s: database is locked by another process, set [store.tokens] secret to sign tokens while rtmp-auth is running", config.Path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", config.Path, err)
+	}
+	defer db.Close()
+
+	var secret []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(boltMeta); meta != nil {
+			// values are only valid during the transaction
+			secret = append([]byte{}, meta.Get(boltSecret)...)
+		}
+		return nil
+	})
+	return secret, err
+}
+
+// load reads the state from a transaction
+func (bb *BoltBackend) load(tx *bolt.Tx) (*storage.State, error) {
+	state := &storage.State{}
+	if secret := tx.Bucket(boltMeta).Get(boltSecret); secret != nil {
+		// values are only valid during the transaction
+		state.Secret = append([]byte{}, secret...)
+	}
+	err := tx.Bucket(boltStreams).ForEach(func(id []byte, value []byte) error {
+		stream := &storage.Stream{}
+		if err := proto.Unmarshal(value, stream); err != nil {
+			return fmt.Errorf("failed to parse stream %s: %w", id, err)
+		}
+		state.Streams = append(state.Streams, stream)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Read returns the stored state, or an empty state with the error like the other backends
+func (bb *BoltBackend) Read() (*storage.State, error) {
+	var state *storage.State
+	err := bb.db.View(func(tx *bolt.Tx) error {
+		var err error
+		state, err = bb.load(tx)
+		return err
+	})
+	if err != nil {
+		return &storage.State{}, err
+	}
+	return state, nil
+}
+
+// Update runs fn on the state in a write transaction and stores the changed streams
+func (bb *BoltBackend) Update(fn func(state *storage.State) error) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		old, err := bb.load(tx)
+		if err != nil {
+			return err
+		}
+		state := proto.Clone(old).(*storage.State)
+		if err := fn(state); err != nil {
+			return err
+		}
+
+		if !bytes.Equal(old.Secret, state.Secret) {
+			if err := tx.Bucket(boltMeta).Put(boltSecret, state.Secret); err != nil {
+				return err
+			}
+		}
+
+		streams := tx.Bucket(boltStreams)
+		previous := make(map[string]*storage.Stream, len(old.Streams))
+		for _, stream := range old.Streams {
+			previous[stream.Id] = stream
+		}
+		for _, stream := range state.Streams {
+			prev, ok := previous[stream.Id]
+			delete(previous, stream.Id)
+			if ok && proto.Equal(prev, stream) {
+				continue
+			}
+			value, err := proto.Marshal(stream)
+			if err != nil {
+				return fmt.Errorf("marshal: %w", err)
+			}
+			if err := streams.Put([]byte(stream.Id), value); err != nil {
+				return err
+			}
+		}
+
+		// remaining streams were removed
+		for id := range previous {
+			if err := streams.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/voc/rtmp-auth/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.bolt")
+	backend, err := NewBoltBackend(BoltBackendConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb := backend.(*BoltBackend)
+	defer bb.db.Close()
+
+	err = bb.Update(func(state *storage.State) error {
+		state.Streams = append(state.Streams,
+			&storage.Stream{Id: "a", Application: "stream", Name: "a"},
+			&storage.Stream{Id: "b", Application: "stream", Name: "b"})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bb.Update(func(state *storage.State) error {
+		removeStream(state, "a")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := bb.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Secret) == 0 {
+		t.Error("no secret generated")
+	}
+	if len(state.Streams) != 1 || state.Streams[0].Id != "b" {
+		t.Errorf("streams = %v, want only b", state.Streams)
+	}
+}
+
+func TestBoltBackendCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.bolt")
+	backend, err := NewBoltBackend(BoltBackendConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb := backend.(*BoltBackend)
+	defer bb.db.Close()
+
+	err = bb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStreams).Put([]byte("broken"), []byte{0xff, 0xff})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := bb.Read()
+	if err == nil {
+		t.Error("expected error for corrupt record")
+	}
+	if state == nil {
+		t.Fatal("read returned no state")
+	}
+}
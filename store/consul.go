@@ -1,11 +1,13 @@
 package store
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,42 +17,96 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-type ConsulBackendConfig struct{}
+// ConsulBackendConfig configures the consul client, empty fields fall back to
+// the consul defaults and CONSUL_* environment variables
+type ConsulBackendConfig struct {
+	// Address of the consul agent, e.g. "127.0.0.1:8500"
+	Address string
+	// URI scheme (http|https)
+	Scheme     string
+	Datacenter string
+	Namespace  string
+	// ACL token, TokenFile takes precedence if set
+	Token     string `json:"-"`
+	TokenFile string `toml:"token-file"`
+	// TLS client config
+	CAFile             string `toml:"ca-file"`
+	CertFile           string `toml:"cert-file"`
+	KeyFile            string `toml:"key-file"`
+	InsecureSkipVerify bool   `toml:"insecure-skip-verify"`
+	// KV prefix the state is stored under, each stream is stored
+	// at <key>/streams/<id> and the secret at <key>/secret
+	Key string
+	// TTL of the consul session active publishes are bound to
+	SessionTTL string `toml:"session-ttl"`
+}
 
+// ConsulBackend stores the state in the consul KV store, one key per stream
 type ConsulBackend struct {
+	prefix    string
 	cache     *storage.State
 	client    *api.Client
 	kv        *api.KV
 	lastIndex uint64
 	mutex     sync.RWMutex
 	queryOpts api.QueryOptions
+	// updateMutex serializes updates of this instance
+	updateMutex sync.Mutex
+	// consul session holding the active keys of this instance
+	session    string
+	sessionTTL string
 }
 
 func NewConsulBackend(config ConsulBackendConfig) (Backend, error) {
+	prefix := strings.TrimSuffix(config.Key, "/")
+	if prefix == "" {
+		return nil, errors.New("consul key must not be empty")
+	}
+	sessionTTL := config.SessionTTL
+	if sessionTTL == "" {
+		sessionTTL = defaultSessionTTL
+	}
+	if _, err := time.ParseDuration(sessionTTL); err != nil {
+		return nil, fmt.Errorf("session-ttl: %w", err)
+	}
+
 	// Get a new client
-	client, err := api.NewClient(api.DefaultConfig())
+	client, err := api.NewClient(consulClientConfig(config))
 	if err != nil {
 		return nil, err
 	}
 	cb := &ConsulBackend{
-		client:    client,
-		kv:        client.KV(),
-		queryOpts: api.QueryOptions{},
-		cache:     &storage.State{},
+		prefix:     prefix,
+		client:     client,
+		kv:         client.KV(),
+		queryOpts:  api.QueryOptions{},
+		cache:      &storage.State{},
+		sessionTTL: sessionTTL,
 	}
 
-	// Generate secret
-	state, err := cb.Read()
-	if err != nil {
+	if err := cb.createSession(); err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+	go cb.renewSession()
+
+	if _, err := cb.Read(); err != nil {
 		return nil, err
 	}
-	if len(state.Secret) == 0 {
+	if err := cb.migrate(); err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+
+	// Generate secret
+	err = cb.Update(func(state *storage.State) error {
+		if len(state.Secret) != 0 {
+			return errUnchanged
+		}
 		state.Secret = make([]byte, 32)
 		rand.Read(state.Secret)
-		err := cb.Write(state)
-		if err != nil {
-			return nil, err
-		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errUnchanged) {
+		return nil, err
 	}
 
 	err = cb.watch()
@@ -61,11 +117,141 @@ func NewConsulBackend(config ConsulBackendConfig) (Backend, error) {
 	return cb, nil
 }
 
-// Watch watches the consul key for changes
+// consulClientConfig applies the configured options on top of the consul defaults
+func consulClientConfig(config ConsulBackendConfig) *api.Config {
+	cc := api.DefaultConfig()
+	if config.Address != "" {
+		cc.Address = config.Address
+	}
+	if config.Scheme != "" {
+		cc.Scheme = config.Scheme
+	}
+	if config.Datacenter != "" {
+		cc.Datacenter = config.Datacenter
+	}
+	if config.Namespace != "" {
+		cc.Namespace = config.Namespace
+	}
+	if config.Token != "" {
+		cc.Token = config.Token
+	}
+	if config.TokenFile != "" {
+		cc.TokenFile = config.TokenFile
+	}
+	if config.CAFile != "" {
+		cc.TLSConfig.CAFile = config.CAFile
+	}
+	if config.CertFile != "" {
+		cc.TLSConfig.CertFile = config.CertFile
+	}
+	if config.KeyFile != "" {
+		cc.TLSConfig.KeyFile = config.KeyFile
+	}
+	if config.InsecureSkipVerify {
+		cc.TLSConfig.InsecureSkipVerify = true
+	}
+	return cc
+}
+
+// readConsulSecret reads the secret without creating a session or migrating the state
+func readConsulSecret(config ConsulBackendConfig) ([]byte, error) {
+	client, err := api.NewClient(consulClientConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cb := &ConsulBackend{prefix: strings.TrimSuffix(config.Key, "/")}
+	opts := api.QueryOptions{}
+	pair, _, err := client.KV().Get(cb.secretKey(), opts.WithContext(ctx))
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return pair.Value, nil
+}
+
+func (cb *ConsulBackend) secretKey() string {
+	return cb.prefix + "/secret"
+}
+
+func (cb *ConsulBackend) streamKey(id string) string {
+	return cb.prefix + "/streams/" + id
+}
+
+// migratedKey marks the import of the legacy state as complete
+func (cb *ConsulBackend) migratedKey() string {
+	return cb.prefix + "/migrated"
+}
+
+// migrate imports the state from a single protobuf value at the prefix key, as stored by previous versions.
+// Large imports are split into several transactions, so streams which are not stored yet
+// are added until the migration is marked complete. An interrupted import resumes on the next start.
+func (cb *ConsulBackend) migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	done, _, err := cb.kv.Get(cb.migratedKey(), cb.queryOpts.WithContext(ctx))
+	if err != nil || done != nil {
+		return err
+	}
+	pair, _, err := cb.kv.Get(cb.prefix, cb.queryOpts.WithContext(ctx))
+	if err != nil || pair == nil {
+		return err
+	}
+	var legacy storage.State
+	if err := proto.Unmarshal(pair.Value, &legacy); err != nil {
+		return fmt.Errorf("failed to parse state: %w", err)
+	}
+	// Clear active information of the previous instance
+	for _, stream := range legacy.Streams {
+		stream.Active = false
+		stream.Session = nil
+	}
+
+	imported := 0
+	err = cb.Update(func(state *storage.State) error {
+		imported = 0
+		stored := make(map[string]bool, len(state.Streams))
+		for _, stream := range state.Streams {
+			stored[stream.Id] = true
+		}
+		for _, stream := range legacy.Streams {
+			if !stored[stream.Id] {
+				state.Streams = append(state.Streams, proto.Clone(stream).(*storage.Stream))
+				imported++
+			}
+		}
+		secret := len(state.Secret) == 0 && len(legacy.Secret) != 0
+		if secret {
+			state.Secret = legacy.Secret
+		}
+		if imported == 0 && !secret {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errUnchanged) {
+		return err
+	}
+
+	// streams removed later must not be imported again
+	putCtx, putCancel := context.WithTimeout(context.Background(), time.Second)
+	defer putCancel()
+	opts := api.WriteOptions{}
+	_, err = cb.kv.Put(&api.KVPair{Key: cb.migratedKey(), Value: []byte("1")}, opts.WithContext(putCtx))
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated %d streams from consul key %s, the key can be removed\n", imported, cb.prefix)
+	return nil
+}
+
+// Watch watches the consul prefix for changes
 func (cb *ConsulBackend) watch() error {
 	query := map[string]interface{}{
-		"type": "key",
-		"key":  "stream_auth",
+		"type":   "keyprefix",
+		"prefix": cb.prefix + "/",
 	}
 	plan, err := watch.Parse(query)
 	if err != nil {
@@ -81,41 +267,91 @@ func (cb *ConsulBackend) watch() error {
 
 // handleWatch updates the cache on consul changes
 func (cb *ConsulBackend) handleWatch(b watch.BlockingParamVal, update interface{}) {
-	pair, ok := update.(*api.KVPair)
+	pairs, ok := update.(api.KVPairs)
 	if !ok {
 		log.Println("watch: invalid update")
 		return
 	}
-	if pair == nil {
+	index, ok := b.(watch.WaitIndexVal)
+	if !ok {
+		log.Println("watch: invalid index")
+		return
+	}
+	state, _, err := cb.parse(pairs)
+	if err != nil {
+		log.Println("watch:", err)
 		return
 	}
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
-	if err := proto.Unmarshal(pair.Value, cb.cache); err != nil {
-		log.Println("watch: failed to parse state: %w", err)
+	cb.cache = state
+	cb.lastIndex = uint64(index)
+}
+
+// parse builds the state from the pairs under the prefix,
+// returns the state and the modify index of each key
+func (cb *ConsulBackend) parse(pairs api.KVPairs) (*storage.State, map[string]uint64, error) {
+	state := &storage.State{}
+	indexes := make(map[string]uint64, len(pairs))
+	sessions := make(map[string]*storage.Session)
+	streamPrefix := cb.streamKey("")
+	activePrefix := cb.activeKey("")
+	for _, pair := range pairs {
+		switch {
+		case pair.Key == cb.secretKey():
+			state.Secret = pair.Value
+		case strings.HasPrefix(pair.Key, streamPrefix):
+			stream := &storage.Stream{}
+			if err := proto.Unmarshal(pair.Value, stream); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse stream %s: %w", pair.Key, err)
+			}
+			state.Streams = append(state.Streams, stream)
+		case strings.HasPrefix(pair.Key, activePrefix):
+			session := &storage.Session{}
+			if err := proto.Unmarshal(pair.Value, session); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse session %s: %w", pair.Key, err)
+			}
+			sessions[strings.TrimPrefix(pair.Key, activePrefix)] = session
+		default:
+			continue
+		}
+		indexes[pair.Key] = pair.ModifyIndex
+	}
+
+	// the active state is only taken from the active keys
+	for _, stream := range state.Streams {
+		stream.Session, stream.Active = sessions[stream.Id]
+	}
+	return state, indexes, nil
+}
+
+// get reads the state and the modify index of each key directly from consul
+func (cb *ConsulBackend) get() (*storage.State, map[string]uint64, uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	pairs, meta, err := cb.kv.List(cb.prefix+"/", cb.queryOpts.WithContext(ctx))
+	if err != nil {
+		return nil, nil, 0, err
 	}
-	cb.lastIndex = pair.ModifyIndex
+	state, indexes, err := cb.parse(pairs)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return state, indexes, meta.LastIndex, nil
 }
 
 // Read directly from consul
 func (cb *ConsulBackend) read() (*storage.State, error) {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
 
-	pair, _, err := cb.kv.Get("stream_auth", cb.queryOpts.WithContext(ctx))
+	state, _, index, err := cb.get()
 	if err != nil {
 		return cb.getCache(), err
 	}
-
-	if pair != nil {
-		if err := proto.Unmarshal(pair.Value, cb.cache); err != nil {
-			return cb.getCache(), fmt.Errorf("failed to parse state: %w", err)
-		}
-		cb.lastIndex = pair.ModifyIndex
-	}
-
+	cb.cache = state
+	cb.lastIndex = index
 	return cb.getCache(), nil
 }
 
@@ -133,41 +369,125 @@ func (cb *ConsulBackend) cachedRead() (*storage.State, error) {
 
 // Read from backend
 func (cb *ConsulBackend) Read() (*storage.State, error) {
-	if cb.lastIndex != 0 {
+	cb.mutex.RLock()
+	cached := cb.lastIndex != 0
+	cb.mutex.RUnlock()
+	if cached {
 		return cb.cachedRead()
 	}
 	return cb.read()
 }
 
-// Write to consul KV
-func (cb *ConsulBackend) Write(state *storage.State) error {
-	if state == nil {
-		return errors.New("state should not be nil")
+const (
+	// consulRetries is the number of attempts of an update if the state changed concurrently
+	consulRetries = 10
+	// consulTxnOps is the maximum number of operations in a consul transaction
+	consulTxnOps = 64
+)
+
+// Update runs fn on the current state and writes the changed streams with check-and-set,
+// retrying if one of them was changed concurrently
+func (cb *ConsulBackend) Update(fn func(state *storage.State) error) error {
+	// serialize local updates, so only other instances cause retries
+	cb.updateMutex.Lock()
+	defer cb.updateMutex.Unlock()
+
+	for attempt := 0; attempt < consulRetries; attempt++ {
+		old, indexes, _, err := cb.get()
+		if err != nil {
+			return err
+		}
+		state := proto.Clone(old).(*storage.State)
+		if err := fn(state); err != nil {
+			return err
+		}
+
+		ops, err := cb.diff(old, state, indexes)
+		if err != nil {
+			return err
+		}
+		success, err := cb.commit(ops)
+		if err != nil {
+			return err
+		}
+		if success {
+			// update directly so cached reads can return a correct response
+			cb.mutex.Lock()
+			cb.cache = state
+			cb.mutex.Unlock()
+			return nil
+		}
+		time.Sleep(time.Duration(rand.Intn(50)+10) * time.Millisecond)
 	}
+	return errors.New("state changed during request, please try again")
+}
 
-	cb.mutex.Lock()
-	defer cb.mutex.Unlock()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+// diff returns the check-and-set operations to store the keys which changed from old to state
+func (cb *ConsulBackend) diff(old *storage.State, state *storage.State, indexes map[string]uint64) (api.KVTxnOps, error) {
+	var ops api.KVTxnOps
+	if !bytes.Equal(old.Secret, state.Secret) {
+		key := cb.secretKey()
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVCAS, Key: key, Value: state.Secret, Index: indexes[key]})
+	}
 
-	// marshal protobuf
-	res, err := proto.Marshal(state)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+	previous := make(map[string]*storage.Stream, len(old.Streams))
+	for _, stream := range old.Streams {
+		previous[stream.Id] = stream
 	}
+	for _, stream := range state.Streams {
+		prev := previous[stream.Id]
+		delete(previous, stream.Id)
+		active, err := cb.activeOps(prev, stream, indexes)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, active...)
 
-	// put
-	p := &api.KVPair{Key: "stream_auth", Value: res, ModifyIndex: cb.lastIndex}
-	opts := api.WriteOptions{}
-	success, _, err := cb.kv.CAS(p, opts.WithContext(ctx))
-	if err != nil {
-		return err
+		record := persisted(stream)
+		if prev != nil && proto.Equal(persisted(prev), record) {
+			continue
+		}
+		value, err := proto.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("marshal: %w", err)
+		}
+		// index 0 only creates the key if it doesn't exist yet
+		key := cb.streamKey(stream.Id)
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVCAS, Key: key, Value: value, Index: indexes[key]})
 	}
-	if !success {
-		return errors.New("state changed during request, please try again")
+
+	// remaining streams were removed
+	for id, prev := range previous {
+		active, err := cb.activeOps(prev, nil, indexes)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, active...)
+		key := cb.streamKey(id)
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVDeleteCAS, Key: key, Index: indexes[key]})
 	}
-	// update directly so cached reads can return a correct response
-	cb.cache = state
+	return ops, nil
+}
 
-	return nil
+// commit applies the operations in consul transactions, returns false if a key was changed concurrently.
+// Updates exceeding the transaction limit are split, which is only atomic per transaction.
+func (cb *ConsulBackend) commit(ops api.KVTxnOps) (bool, error) {
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > consulTxnOps {
+			n = consulTxnOps
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		opts := api.QueryOptions{}
+		success, _, _, err := cb.kv.Txn(ops[:n], opts.WithContext(ctx))
+		cancel()
+		if err != nil {
+			return false, err
+		}
+		if !success {
+			return false, nil
+		}
+		ops = ops[n:]
+	}
+	return true, nil
 }
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/voc/rtmp-auth/storage"
+	"google.golang.org/protobuf/proto"
+)
+
+// The consul backend doesn't persist the active state of streams.
+// Each instance holds a consul session with a TTL, an active stream is stored
+// at <key>/active/<id> locked by the session of the instance which activated it,
+// so it is removed by consul once that instance stops renewing its session.
+
+// defaultSessionTTL is used if no session TTL is configured
+const defaultSessionTTL = "15s"
+
+func (cb *ConsulBackend) activeKey(id string) string {
+	return cb.prefix + "/active/" + id
+}
+
+// createSession creates the session the active keys of this instance are bound to
+func (cb *ConsulBackend) createSession() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	entry := &api.SessionEntry{
+		Name:     "rtmp-auth",
+		TTL:      cb.sessionTTL,
+		Behavior: api.SessionBehaviorDelete,
+		// let other instances take over streams of a dead instance immediately
+		LockDelay: time.Millisecond,
+	}
+	opts := api.WriteOptions{}
+	id, _, err := cb.client.Session().Create(entry, opts.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.session = id
+	return nil
+}
+
+func (cb *ConsulBackend) sessionID() string {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+	return cb.session
+}
+
+// renewSession keeps the session alive and replaces it if it was lost
+func (cb *ConsulBackend) renewSession() {
+	for {
+		err := cb.client.Session().RenewPeriodic(cb.sessionTTL, cb.sessionID(), &api.WriteOptions{}, nil)
+		log.Println("consul session lost, streams published through this instance are inactive:", err)
+		for {
+			err := cb.createSession()
+			if err == nil {
+				break
+			}
+			log.Println("consul session:", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// persisted returns the stream without its active state, which is stored in the active keys
+func persisted(stream *storage.Stream) *storage.Stream {
+	record := proto.Clone(stream).(*storage.Stream)
+	record.Active = false
+	record.Session = nil
+	return record
+}
+
+// activeOps returns the operations to store the change of the active state from prev to stream,
+// either may be nil for added or removed streams
+func (cb *ConsulBackend) activeOps(prev *storage.Stream, stream *storage.Stream, indexes map[string]uint64) (api.KVTxnOps, error) {
+	wasActive := prev != nil && prev.Active
+	active := stream != nil && stream.Active
+	if !active {
+		if !wasActive {
+			return nil, nil
+		}
+		key := cb.activeKey(prev.Id)
+		return api.KVTxnOps{{Verb: api.KVDeleteCAS, Key: key, Index: indexes[key]}}, nil
+	}
+	if wasActive && proto.Equal(prev.Session, stream.Session) {
+		return nil, nil
+	}
+
+	session := stream.Session
+	if session == nil {
+		session = &storage.Session{}
+	}
+	value, err := proto.Marshal(session)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+	key := cb.activeKey(stream.Id)
+	if wasActive {
+		// keep the session of the instance which activated the stream, e.g. on lease refresh
+		return api.KVTxnOps{{Verb: api.KVCAS, Key: key, Value: value, Index: indexes[key]}}, nil
+	}
+	// fails if another instance activated the stream concurrently
+	return api.KVTxnOps{{Verb: api.KVLock, Key: key, Value: value, Session: cb.sessionID()}}, nil
+}
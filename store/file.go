@@ -1,7 +1,6 @@
 package store
 
 import (
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -37,6 +36,22 @@ func NewFileBackend(config FileBackendConfig) (Backend, error) {
 	return fb, nil
 }
 
+// readFileSecret reads the secret from the state file without writing it
+func readFileSecret(config FileBackendConfig) ([]byte, error) {
+	data, err := ioutil.ReadFile(config.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state storage.State
+	if err := proto.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse stream state: %w", err)
+	}
+	return state.Secret, nil
+}
+
 // Read parses the store state from a file
 func (fb *FileBackend) read() (*storage.State, error) {
 	var state storage.State
@@ -55,6 +70,7 @@ func (fb *FileBackend) read() (*storage.State, error) {
 	// Clear active information for old streams
 	for _, stream := range state.Streams {
 		stream.Active = false
+		stream.Session = nil
 	}
 
 	// Generate secret
@@ -92,12 +108,17 @@ func (fb *FileBackend) Read() (*storage.State, error) {
 	return res, nil
 }
 
-func (fb *FileBackend) Write(state *storage.State) error {
-	if state == nil {
-		return errors.New("state should not be nil")
-	}
+// Update runs fn on a copy of the state, the lock is held until the state is saved
+func (fb *FileBackend) Update(fn func(state *storage.State) error) error {
 	fb.mutex.Lock()
 	defer fb.mutex.Unlock()
+	state := proto.Clone(fb.cache).(*storage.State)
+	if err := fn(state); err != nil {
+		return err
+	}
+	if err := fb.save(state); err != nil {
+		return err
+	}
 	fb.cache = state
-	return fb.save(state)
+	return nil
 }
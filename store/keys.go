@@ -0,0 +1,138 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/voc/rtmp-auth/storage"
+)
+
+// PrimaryKey is the name of the auth_key of a stream in logs
+const PrimaryKey = "primary"
+
+// keyValid returns whether an additional key may still be used
+func keyValid(key *storage.Key, now int64) bool {
+	return key.Expire == -1 || key.Expire > now
+}
+
+// matchKey returns the name of the key of a stream matching auth
+func matchKey(stream *storage.Stream, auth string, now int64) (string, bool) {
+	if stream.AuthKey == auth {
+		return PrimaryKey, true
+	}
+	for _, key := range stream.Keys {
+		if key.Key == auth && keyValid(key, now) {
+			return key.Name, true
+		}
+	}
+	return "", false
+}
+
+// ValidateKeys checks that the additional keys of a stream are named uniquely, not empty
+// and can still be used
+func ValidateKeys(keys []*storage.Key) error {
+	now := time.Now().Unix()
+	names := make(map[string]bool)
+	for _, key := range keys {
+		if key.Name == "" || key.Key == "" {
+			return fmt.Errorf("key name and key must be set")
+		}
+		if !keyValid(key, now) {
+			return fmt.Errorf("key '%v' must expire in the future or never (-1)", key.Name)
+		}
+		if key.Name == PrimaryKey || names[key.Name] {
+			return fmt.Errorf("duplicate key name '%v'", key.Name)
+		}
+		names[key.Name] = true
+	}
+	return nil
+}
+
+// AddKey adds a named publish key to a stream
+func (store *Store) AddKey(id string, key *storage.Key) error {
+	return store.update(func(state *storage.State) error {
+		for _, stream := range state.Streams {
+			if stream.Id == id {
+				// expired keys which were not pruned yet must not fail the validation
+				pruneKeys(stream, time.Now().Unix())
+				keys := append(stream.Keys, key)
+				if err := ValidateKeys(keys); err != nil {
+					return err
+				}
+				stream.Keys = keys
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// RemoveKey removes a named publish key from a stream
+func (store *Store) RemoveKey(id string, name string) error {
+	return store.update(func(state *storage.State) error {
+		for _, stream := range state.Streams {
+			if stream.Id != id {
+				continue
+			}
+			for i, key := range stream.Keys {
+				if key.Name == name {
+					stream.Keys = append(stream.Keys[:i], stream.Keys[i+1:]...)
+					return nil
+				}
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// uniqueKeyName returns name, numbered if a key of that name already exists
+func uniqueKeyName(keys []*storage.Key, name string) string {
+	taken := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		taken[key.Name] = true
+	}
+	unique := name
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)", name, i)
+	}
+	return unique
+}
+
+// RotateKey replaces the auth key of a stream,
+// the previous key stays valid until expire
+func (store *Store) RotateKey(id string, newKey string, expire int64) error {
+	now := time.Now()
+	return store.update(func(state *storage.State) error {
+		for _, stream := range state.Streams {
+			if stream.Id != id {
+				continue
+			}
+			pruneKeys(stream, now.Unix())
+			if stream.AuthKey != "" && expire > now.Unix() {
+				// keys rotated within the same second are numbered
+				name := uniqueKeyName(stream.Keys, "rotated "+now.Format("2006-01-02 15:04:05"))
+				keys := append(stream.Keys, &storage.Key{Name: name, Key: stream.AuthKey, Expire: expire})
+				if err := ValidateKeys(keys); err != nil {
+					return err
+				}
+				stream.Keys = keys
+			}
+			stream.AuthKey = newKey
+			return nil
+		}
+		return ErrNotFound
+	})
+}
+
+// pruneKeys removes expired additional keys, returns whether keys were removed
+func pruneKeys(stream *storage.Stream, now int64) bool {
+	keys := stream.Keys[:0]
+	for _, key := range stream.Keys {
+		if keyValid(key, now) {
+			keys = append(keys, key)
+		}
+	}
+	pruned := len(keys) != len(stream.Keys)
+	stream.Keys = keys
+	return pruned
+}
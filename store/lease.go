@@ -0,0 +1,105 @@
+package store
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/voc/rtmp-auth/storage"
+	"google.golang.org/protobuf/proto"
+)
+
+// leaseExpired returns whether the lease of an active stream ran out
+// without being refreshed. Streams without lease never expire.
+func leaseExpired(stream *storage.Stream, now int64) bool {
+	return stream.Session != nil && stream.Session.LeaseExpire != 0 && stream.Session.LeaseExpire <= now
+}
+
+// isActive returns whether a stream is currently being published
+func isActive(stream *storage.Stream, now int64) bool {
+	return stream.Active && !leaseExpired(stream, now)
+}
+
+// newLease sets the lease of a session if leases are enabled
+func (store *Store) newLease(session *storage.Session) {
+	if store.lease > 0 && session != nil {
+		session.LeaseExpire = time.Now().Add(store.lease).Unix()
+	}
+}
+
+// Refresh extends the lease of the active streams on vhost/app/name, returns success
+func (store *Store) Refresh(vhost string, app string, name string) bool {
+	if store.lease == 0 {
+		return true
+	}
+	return store.refresh(func(stream *storage.Stream) bool {
+		return matches(stream, vhost, app, name) && publishedOn(stream, vhost)
+	}) > 0
+}
+
+// RefreshServer extends the leases of all active streams published through an ingest server,
+// identified by its callback address or server id. Returns the number of refreshed streams.
+func (store *Store) RefreshServer(addr string, id string) int {
+	if store.lease == 0 {
+		return 0
+	}
+	return store.refresh(func(stream *storage.Stream) bool {
+		return stream.Session.ServerAddr == addr || (id != "" && stream.Session.Server == id)
+	})
+}
+
+// refresh extends the leases of the matching active streams, returns the number of refreshed streams
+func (store *Store) refresh(match func(stream *storage.Stream) bool) int {
+	var count int
+	err := store.update(func(state *storage.State) error {
+		// the update may be retried, only the committed attempt counts
+		count = 0
+		now := time.Now().Unix()
+		for _, stream := range state.Streams {
+			if !isActive(stream, now) || stream.Session == nil || !match(stream) {
+				continue
+			}
+			store.newLease(stream.Session)
+			count++
+		}
+		if count == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Println(err)
+		}
+		return 0
+	}
+	return count
+}
+
+// ExpireLeases clears the active state of streams whose lease was not refreshed in time
+func (store *Store) ExpireLeases() {
+	var expired []*storage.Stream
+	err := store.update(func(state *storage.State) error {
+		expired = nil
+		now := time.Now().Unix()
+		for _, stream := range state.Streams {
+			if stream.Active && leaseExpired(stream, now) {
+				expired = append(expired, proto.Clone(stream).(*storage.Stream))
+				stream.Active = false
+				stream.Session = nil
+			}
+		}
+		if len(expired) == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("expire leases", err)
+		return
+	}
+
+	for _, stream := range expired {
+		log.Printf("Lease of %s/%s on %s expired\n", stream.Application, stream.Name, stream.Session.Server)
+	}
+}
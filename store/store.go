@@ -1,6 +1,7 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -8,19 +9,58 @@ import (
 	"github.com/google/uuid"
 
 	"github.com/voc/rtmp-auth/storage"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNotFound is returned when no stream with the requested id exists
+var ErrNotFound = errors.New("stream not found")
+
+// Errors returned by Auth
+var (
+	ErrUnknownStream = errors.New("no stream defined for app/name")
+	ErrWrongKey      = errors.New("wrong auth key")
+	ErrBlocked       = errors.New("stream is blocked")
+	ErrExpired       = errors.New("auth expired")
+	ErrConflict      = errors.New("another publisher is active on app/name")
 )
 
 type StoreConfig struct {
 	Backend string
 	File    FileBackendConfig
 	Consul  ConsulBackendConfig
+	Bolt    BoltBackendConfig
+	Tokens  TokenConfig
+	// Keep expired streams flagged as expired instead of removing them
+	KeepExpired bool `toml:"keep-expired"`
+	// Lease duration of active publishes, which have to be refreshed by
+	// periodic callbacks from the ingest server. Disabled if empty.
+	ActiveLease string `toml:"active-lease"`
+}
+
+// Dropper disconnects the active publisher of app/name on vhost,
+// returns false if it can't reach publishers of the application
+type Dropper interface {
+	Drop(vhost string, app string, name string) (bool, error)
 }
 
 type Store struct {
-	backend Backend
+	backend     Backend
+	tokens      TokenConfig
+	keepExpired bool
+	lease       time.Duration
+	dropper     Dropper
 }
 
 func NewStore(config StoreConfig) (*Store, error) {
+	var lease time.Duration
+	if config.ActiveLease != "" {
+		var err error
+		lease, err = time.ParseDuration(config.ActiveLease)
+		if err != nil {
+			return nil, fmt.Errorf("active-lease: %w", err)
+		}
+	}
+
 	var backend Backend
 	var err error
 	switch config.Backend {
@@ -28,6 +68,8 @@ func NewStore(config StoreConfig) (*Store, error) {
 		backend, err = NewFileBackend(config.File)
 	case "consul":
 		backend, err = NewConsulBackend(config.Consul)
+	case "bolt":
+		backend, err = NewBoltBackend(config.Bolt)
 	default:
 		err = fmt.Errorf("Unknown backend %s", config.Backend)
 	}
@@ -35,105 +77,278 @@ func NewStore(config StoreConfig) (*Store, error) {
 		return nil, err
 	}
 	log.Printf("store: using %s backend\n", config.Backend)
-	return &Store{backend: backend}, nil
+	return &Store{
+		backend:     backend,
+		tokens:      config.Tokens,
+		keepExpired: config.KeepExpired,
+		lease:       lease,
+	}, nil
+}
+
+// SetDropper sets the dropper used to disconnect active publishers
+// when their stream is blocked, removed or expires
+func (store *Store) SetDropper(dropper Dropper) {
+	store.dropper = dropper
+}
+
+// drop disconnects the publisher of an active stream in the background
+func (store *Store) drop(stream *storage.Stream, reason string) {
+	if store.dropper == nil || !stream.Active {
+		return
+	}
+	// drop the publish on the vhost it was started on
+	vhost, app, name := stream.Vhost, stream.Application, stream.Name
+	if stream.Session != nil {
+		vhost = stream.Session.Vhost
+	}
+	go func() {
+		dropped, err := store.dropper.Drop(vhost, app, name)
+		if err != nil {
+			log.Printf("Failed to drop %s publisher %s/%s: %v\n", reason, app, name, err)
+			return
+		}
+		if !dropped {
+			return
+		}
+		log.Printf("Dropped %s publisher %s/%s\n", reason, app, name)
+	}()
+}
+
+// isExpired returns whether the auth of a stream has expired
+func isExpired(stream *storage.Stream, now int64) bool {
+	return stream.AuthExpire != -1 && stream.AuthExpire <= now
 }
 
-// GetAppNameActive returns true if there is an active stream on app/name
-func getAppNameActive(state *storage.State, app string, name string) bool {
+// blocked returns whether a stream on vhost/app/name is blocked, which also blocks tokens
+func blocked(state *storage.State, vhost string, app string, name string) bool {
+	for _, stream := range state.Streams {
+		if matches(stream, vhost, app, name) && stream.Blocked {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns whether a stream is defined for app/name on vhost,
+// streams without vhost match every vhost
+func matches(stream *storage.Stream, vhost string, app string, name string) bool {
+	return stream.Application == app && stream.Name == name && (stream.Vhost == "" || stream.Vhost == vhost)
+}
+
+// publishedOn returns whether the active publish of a stream was started on vhost
+func publishedOn(stream *storage.Stream, vhost string) bool {
+	return stream.Session == nil || stream.Session.Vhost == vhost
+}
+
+// GetAppNameActive returns true if there is an active stream on vhost/app/name
+func getAppNameActive(state *storage.State, vhost string, app string, name string) bool {
 	active := false
+	now := time.Now().Unix()
 	for _, stream := range state.Streams {
-		if stream.Application == app && stream.Name == name && stream.Active {
+		if matches(stream, vhost, app, name) && isActive(stream, now) && publishedOn(stream, vhost) {
 			active = true
 		}
 	}
 	return active
 }
 
-// Auth looks up if a given app/name/key tuple is allowed to publish.
-// Returns success (bool) and the matched streams id string
-// TODO: Return error values to distinguish i.e. 401 Unauthorized
-// and 409 Conflict return codes in the publish request handler
-func (store *Store) Auth(app string, name string, auth string) (success bool, id string) {
+// Auth looks up if a given vhost/app/name/key tuple is allowed to publish.
+// Returns the matched streams id, the name of the matched key
+// and one of the Err* auth errors on failure
+func (store *Store) Auth(vhost string, app string, name string, auth string) (id string, keyName string, err error) {
 	state, err := store.backend.Read()
 	if err != nil {
-		return false, ""
+		return "", "", err
 	}
 
+	now := time.Now().Unix()
+	known := false
 	for _, stream := range state.Streams {
-		if stream.Application == app && stream.Name == name && stream.AuthKey == auth {
-			if !stream.Blocked {
-				var conflict bool
-				if stream.Active {
-					conflict = false
-				} else {
-					conflict = getAppNameActive(state, app, name)
-				}
-				return !conflict, stream.Id
-			} else {
-				return false, stream.Id
-			}
+		if !matches(stream, vhost, app, name) {
+			continue
+		}
+		known = true
+		matched, ok := matchKey(stream, auth, now)
+		if !ok {
+			continue
+		}
+		if stream.Blocked {
+			return stream.Id, matched, ErrBlocked
+		}
+		if isExpired(stream, now) {
+			return stream.Id, matched, ErrExpired
+		}
+		if !stream.Active && getAppNameActive(state, vhost, app, name) {
+			return stream.Id, matched, ErrConflict
+		}
+		return stream.Id, matched, nil
+	}
+
+	if store.tokens.Enabled {
+		err := store.authToken(state, vhost, app, name, auth)
+		if err != errMalformedToken {
+			return "", "token", err
 		}
 	}
-	return false, ""
+
+	if known {
+		return "", "", ErrWrongKey
+	}
+	return "", "", ErrUnknownStream
+}
+
+// authToken checks a signed publish token for app/name,
+// tokens are rejected if a stream defined for app/name is blocked
+func (store *Store) authToken(state *storage.State, vhost string, app string, name string, auth string) error {
+	key, err := store.TokenKey()
+	if err != nil {
+		return err
+	}
+	if err := VerifyToken(key, ScopePublish, app, name, auth); err != nil {
+		return err
+	}
+
+	if blocked(state, vhost, app, name) {
+		return ErrBlocked
+	}
+	if getAppNameActive(state, vhost, app, name) {
+		return ErrConflict
+	}
+	return nil
 }
 
-// SetActive sets a stream to active state by its id, returns success
-func (store *Store) SetActive(id string) bool {
+// KeyName returns the name of the stream defined for vhost/app with the given auth key,
+// used for publishers which send their key as stream name
+func (store *Store) KeyName(vhost string, app string, key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
 	state, err := store.backend.Read()
 	if err != nil {
-		return false
+		return "", false
 	}
 
-	success := false
+	now := time.Now().Unix()
 	for _, stream := range state.Streams {
-		if stream.Id == id {
-			stream.Active = true
-			if err := store.backend.Write(state); err != nil {
-				log.Println(err)
-			} else {
-				success = true
-			}
+		if stream.Application != app || (stream.Vhost != "" && stream.Vhost != vhost) {
+			continue
+		}
+		if _, ok := matchKey(stream, key, now); ok {
+			return stream.Name, true
 		}
 	}
-	return success
+	return "", false
 }
 
-// SetInactive unsets the active state for all streams defined for app/name, returns success
-func (store *Store) SetInactive(app string, name string) bool {
+// AuthPlay looks up if a given vhost/app/name/key tuple is allowed to play.
+// Streams without play key may be played by anyone, blocked and expired streams by no one.
+// Returns the matched streams id and one of the Err* auth errors on failure
+func (store *Store) AuthPlay(vhost string, app string, name string, key string) (id string, err error) {
 	state, err := store.backend.Read()
 	if err != nil {
-		return false
+		return "", err
 	}
 
-	success := false
+	now := time.Now().Unix()
+	known := false
 	for _, stream := range state.Streams {
-		if stream.Application == app && stream.Name == name {
-			stream.Active = false
-			if err := store.backend.Write(state); err != nil {
-				log.Println(err)
-			} else {
-				success = true
+		if !matches(stream, vhost, app, name) {
+			continue
+		}
+		known = true
+		if stream.PlayKey != key && stream.PlayKey != "" {
+			continue
+		}
+		if stream.Blocked {
+			return stream.Id, ErrBlocked
+		}
+		if isExpired(stream, now) {
+			return stream.Id, ErrExpired
+		}
+		return stream.Id, nil
+	}
+
+	if store.tokens.Enabled {
+		tokenKey, err := store.TokenKey()
+		if err != nil {
+			return "", err
+		}
+		err = VerifyToken(tokenKey, ScopePlay, app, name, key)
+		if err == nil && blocked(state, vhost, app, name) {
+			return "", ErrBlocked
+		}
+		if err != errMalformedToken {
+			return "", err
+		}
+	}
+
+	if known {
+		return "", ErrWrongKey
+	}
+	return "", ErrUnknownStream
+}
+
+// SetActive sets a stream to active state by its id and records the publish session.
+// Returns ErrConflict if another stream became active on the same vhost/app/name since Auth,
+// e.g. through another instance sharing the backend.
+func (store *Store) SetActive(id string, session *storage.Session) error {
+	store.newLease(session)
+	return store.update(func(state *storage.State) error {
+		for _, stream := range state.Streams {
+			if stream.Id != id {
+				continue
+			}
+			if !stream.Active && getAppNameActive(state, session.GetVhost(), stream.Application, stream.Name) {
+				return ErrConflict
+			}
+			stream.Active = true
+			stream.Session = session
+			return nil
+		}
+		return ErrNotFound
+	})
+}
+
+// SetInactive unsets the active state for all streams published on vhost/app/name, returns success
+func (store *Store) SetInactive(vhost string, app string, name string) bool {
+	err := store.update(func(state *storage.State) error {
+		found := false
+		for _, stream := range state.Streams {
+			if matches(stream, vhost, app, name) && publishedOn(stream, vhost) {
+				stream.Active = false
+				stream.Session = nil
+				found = true
 			}
 		}
+		if !found {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Println(err)
 	}
-	return success
+	return err == nil
 }
 
 // SetBlocked changes a streams blocked state
 func (store *Store) SetBlocked(id string, isBlocked bool) error {
-	state, err := store.backend.Read()
+	var blocked *storage.Stream
+	err := store.update(func(state *storage.State) error {
+		for _, stream := range state.Streams {
+			if stream.Id == id {
+				stream.Blocked = isBlocked
+				blocked = stream
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
 	if err != nil {
 		return err
 	}
-
-	for _, stream := range state.Streams {
-		if stream.Id == id {
-			stream.Blocked = isBlocked
-			if err := store.backend.Write(state); err != nil {
-				return err
-			}
-			return nil
-		}
+	if isBlocked {
+		store.drop(blocked, "blocked")
 	}
 	return nil
 }
@@ -146,70 +361,133 @@ func (store *Store) AddStream(stream *storage.Stream) error {
 
 	stream.Id = id.String()
 	stream.Blocked = false
-	state, err := store.backend.Read()
-	if err != nil {
-		return err
-	}
-	state.Streams = append(state.Streams, stream)
-
-	if err := store.backend.Write(state); err != nil {
-		return err
-	}
-
-	return nil
+	return store.update(func(state *storage.State) error {
+		state.Streams = append(state.Streams, stream)
+		return nil
+	})
 }
 
-func (store *Store) RemoveStream(id string) error {
-	state, err := store.backend.Read()
+// UpdateStream changes a stream within a single transaction and returns the updated stream.
+// fn may be called multiple times and must not have side effects, an error aborts the update.
+func (store *Store) UpdateStream(id string, fn func(stream *storage.Stream) error) (*storage.Stream, error) {
+	var updated *storage.Stream
+	err := store.update(func(state *storage.State) error {
+		for _, stream := range state.Streams {
+			if stream.Id != id {
+				continue
+			}
+			// expired keys which were not pruned yet must not fail the validation
+			pruneKeys(stream, time.Now().Unix())
+			if err := fn(stream); err != nil {
+				return err
+			}
+			stream.Id = id
+			stream.Expired = isExpired(stream, time.Now().Unix())
+			updated = proto.Clone(stream).(*storage.Stream)
+			return nil
+		}
+		return ErrNotFound
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return updated, nil
+}
+
+// removeStream removes a stream from the state, returns the removed stream or nil
+func removeStream(state *storage.State, id string) *storage.Stream {
 	s := state.Streams
-	found := false
-	var index int
-	var stream *storage.Stream
-	for index, stream = range s {
+	for index, stream := range s {
 		if stream.Id == id {
-			found = true
-			break
+			copy(s[index:], s[index+1:]) // Shift a[i+1:] left one index
+			s[len(s)-1] = nil            // Erase last element (write zero value)
+			state.Streams = s[:len(s)-1] // Truncate slice
+			return stream
 		}
 	}
+	return nil
+}
 
-	if found {
-		copy(s[index:], s[index+1:]) // Shift a[i+1:] left one index
-		s[len(s)-1] = nil            // Erase last element (write zero value)
-		state.Streams = s[:len(s)-1] // Truncate slice
-	}
-
-	if err := store.backend.Write(state); err != nil {
+func (store *Store) RemoveStream(id string) error {
+	var removed *storage.Stream
+	err := store.update(func(state *storage.State) error {
+		removed = removeStream(state, id)
+		if removed == nil {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
-
+	store.drop(removed, "removed")
 	return nil
 }
 
-// Expire old streams
+// Expire removes expired streams or flags them as expired if configured to keep them
 func (store *Store) Expire() {
-	var toDelete []string
 	now := time.Now().Unix()
 
-	state, err := store.backend.Read()
-	if err != nil {
-		log.Println("read", err)
-	}
+	var pruned, expired, removed []*storage.Stream
+	err := store.update(func(state *storage.State) error {
+		pruned, expired, removed = nil, nil, nil
+		var toDelete []string
+		for _, stream := range state.Streams {
+			if pruneKeys(stream, now) {
+				pruned = append(pruned, stream)
+			}
+			if !isExpired(stream, now) || stream.Expired {
+				continue
+			}
+			if store.keepExpired {
+				stream.Expired = true
+				expired = append(expired, stream)
+			} else {
+				toDelete = append(toDelete, stream.Id)
+			}
+		}
+		for _, id := range toDelete {
+			removed = append(removed, removeStream(state, id))
+		}
 
-	for _, stream := range state.Streams {
-		if stream.AuthExpire != -1 && stream.AuthExpire < now {
-			log.Printf("Expiring %s/%s\n", stream.Application, stream.Name)
-			toDelete = append(toDelete, stream.Id)
+		if len(pruned)+len(expired)+len(removed) == 0 {
+			return errUnchanged
 		}
+		return nil
+	})
+	if err != nil {
+		log.Println("expire", err)
+		return
 	}
 
-	for _, id := range toDelete {
-		store.RemoveStream(id)
+	for _, stream := range pruned {
+		log.Printf("Removed expired keys of %s/%s\n", stream.Application, stream.Name)
+	}
+	for _, stream := range expired {
+		log.Printf("Expiring %s/%s\n", stream.Application, stream.Name)
+		store.drop(stream, "expired")
+	}
+	for _, stream := range removed {
+		log.Printf("Expiring %s/%s\n", stream.Application, stream.Name)
+		store.drop(stream, "expired")
 	}
 }
 
 func (store *Store) Get() (*storage.State, error) {
 	return store.backend.Read()
 }
+
+// GetStream returns the stream with the given id
+func (store *Store) GetStream(id string) (*storage.Stream, error) {
+	state, err := store.backend.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stream := range state.Streams {
+		if stream.Id == id {
+			return stream, nil
+		}
+	}
+	return nil, ErrNotFound
+}
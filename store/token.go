@@ -0,0 +1,120 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenConfig configures stateless signed publish and play tokens
+type TokenConfig struct {
+	// Enabled allows publishing and playing with a signed token instead of a stored stream
+	Enabled bool
+	// Secret used for signing, derived from the state secret if empty
+	Secret string `json:"-"`
+}
+
+// Token scopes, a token is only valid for the action it was signed for
+const (
+	ScopePublish = "publish"
+	ScopePlay    = "play"
+)
+
+// errMalformedToken is returned if the auth parameter is not a token at all
+var errMalformedToken = errors.New("malformed token")
+
+// tokenContext separates the token key from other uses of the state secret
+const tokenContext = "rtmp-auth token"
+
+// SignToken creates a token which allows scope on app/name until expiry (-1 for never)
+func SignToken(key []byte, scope string, app string, name string, expiry int64) string {
+	exp := strconv.FormatInt(expiry, 10)
+	return exp + "." + tokenSignature(key, scope, app, name, exp)
+}
+
+// VerifyToken checks the signature and expiry of a token,
+// returns ErrWrongKey for invalid signatures and ErrExpired for expired tokens
+func VerifyToken(key []byte, scope string, app string, name string, token string) error {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return errMalformedToken
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errMalformedToken
+	}
+
+	expected := tokenSignature(key, scope, app, name, parts[0])
+	if !hmac.Equal([]byte(parts[1]), []byte(expected)) {
+		return ErrWrongKey
+	}
+
+	if expiry != -1 && expiry < time.Now().Unix() {
+		return ErrExpired
+	}
+	return nil
+}
+
+func tokenSignature(key []byte, scope string, app string, name string, expiry string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{scope, app, name, expiry}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TokensEnabled returns whether signed tokens are accepted
+func (store *Store) TokensEnabled() bool {
+	return store.tokens.Enabled
+}
+
+// TokenKey returns the key used for signing tokens
+func (store *Store) TokenKey() ([]byte, error) {
+	if store.tokens.Secret != "" {
+		return []byte(store.tokens.Secret), nil
+	}
+
+	state, err := store.backend.Read()
+	if err != nil {
+		return nil, err
+	}
+	return deriveTokenKey(state.Secret), nil
+}
+
+// deriveTokenKey derives the token key from the state secret
+func deriveTokenKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(tokenContext))
+	return mac.Sum(nil)
+}
+
+// ReadTokenKey returns the key used for signing tokens without opening the store,
+// so tokens can be signed next to a running instance
+func ReadTokenKey(config StoreConfig) ([]byte, error) {
+	if config.Tokens.Secret != "" {
+		return []byte(config.Tokens.Secret), nil
+	}
+	secret, err := readSecret(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("the state has no secret yet, start rtmp-auth once first")
+	}
+	return deriveTokenKey(secret), nil
+}
+
+// SignToken creates a token for scope on app/name valid until expiry (-1 for never)
+func (store *Store) SignToken(scope string, app string, name string, expiry int64) (string, error) {
+	if scope != ScopePublish && scope != ScopePlay {
+		return "", fmt.Errorf("invalid token scope '%v'", scope)
+	}
+	key, err := store.TokenKey()
+	if err != nil {
+		return "", err
+	}
+	return SignToken(key, scope, app, name, expiry), nil
+}